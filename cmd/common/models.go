@@ -2,9 +2,35 @@ package models
 
 type DbRequest struct {
 	Value string `json:"value"`
+	// TTL in seconds, the value never expires when it's not set
+	TTL int64 `json:"ttl,omitempty"`
+	// Delta is added to the integer value by the increment operation
+	Delta int64 `json:"delta,omitempty"`
 }
 
 type DbResponse struct {
 	Key string `json:"key"`
 	Value string `json:"value"`
 }
+
+type DbKeysResponse struct {
+	Keys []string `json:"keys"`
+}
+
+type DbBatchOperation struct {
+	Key    string `json:"key"`
+	Value  string `json:"value"`
+	Delete bool   `json:"delete"`
+}
+
+type DbBatchRequest struct {
+	Operations []DbBatchOperation `json:"operations"`
+}
+
+type DbBucketsResponse struct {
+	Buckets []string `json:"buckets"`
+}
+
+type DbIndexesResponse struct {
+	Indexes []string `json:"indexes"`
+}
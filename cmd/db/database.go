@@ -1,34 +1,220 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
 	"github.com/AlmostGreatBand/KPI2-2/cmd/common"
 	"github.com/AlmostGreatBand/KPI2-2/datastore"
 	"github.com/AlmostGreatBand/KPI2-2/httptools"
+	"github.com/AlmostGreatBand/KPI2-2/replication"
 	"github.com/AlmostGreatBand/KPI2-2/signal"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
+	"os"
+	"strconv"
 	"strings"
+	"time"
 )
 
 var port = flag.Int("port", 8080, "server port")
 var dir = flag.String("dir", ".", "database storage dir")
+var restore = flag.String("restore", "", "backup archive to restore to the empty storage dir before start")
+var recovery = flag.String("recovery", "fail", "what to do with corrupted records on start: fail, truncate or skip")
+
+var readOnly = flag.Bool("read-only", false, "serve the database in dir without writing to it, it may be used by another server meanwhile")
+var leader = flag.String("leader", "", "url of the leader db server, the server follows it and rejects writes when set")
+var durability = flag.String("sync", "always", "when writes are synced to the disk: always, interval or never")
+var syncInterval = flag.Duration("sync-interval", time.Second, "how often writes are synced with -sync=interval")
+
+var mergePolicy = flag.String("merge-policy", "count", "when segments are merged automatically: count, garbage, tiered or none")
+var mergeSegments = flag.Int("merge-segments", 1, "sealed segments kept before merge with -merge-policy=count, the least merged at once with tiered")
+var mergeGarbageRatio = flag.Float64("merge-garbage-ratio", 0.5, "share of garbage records which triggers merge with -merge-policy=garbage")
+var mergeSizeRatio = flag.Float64("merge-size-ratio", 1, "how much bigger than the merged segment new segments grow before merge with -merge-policy=tiered")
+var mergeWindow = flag.String("merge-window", "", "daily local time window automatic merges are allowed in, for example 01:00-05:00")
+
+var bloomRate = flag.Float64("bloom-rate", 0.01, "false positive rate of the sealed segments bloom filters, 0 disables them")
+var keyFile = flag.String("key-file", "", "file with the hex encoded 32 byte key values are encrypted with, "+datastore.KeyEnv+" is used when not set")
+var oldKeyFiles = flag.String("old-key-files", "", "comma separated files with the previous keys, needed until all the segments are merged after rotation")
+var indexMode = flag.String("index", "memory", "where the indexes of sealed segments are kept: memory or disk")
+
+// values are put and returned raw, without json, when requests have this content type
+const streamType = "application/octet-stream"
+
+var durabilityModes = map[string]datastore.Durability{
+	"always":   datastore.SyncAlways,
+	"interval": datastore.SyncInterval,
+	"never":    datastore.SyncNever,
+}
+
+var indexModes = map[string]datastore.IndexMode{
+	"memory": datastore.IndexInMemory,
+	"disk":   datastore.IndexOnDisk,
+}
+
+var recoveryPolicies = map[string]datastore.RecoveryPolicy{
+	"fail":     datastore.RecoverFail,
+	"truncate": datastore.RecoverTruncate,
+	"skip":     datastore.RecoverSkip,
+}
 
 func main() {
+	flag.Parse()
+
+	opts := datastore.DefaultOptions()
+	policy, ok := recoveryPolicies[*recovery]
+	if !ok {
+		log.Printf("unknown recovery policy: %s\n", *recovery)
+		return
+	}
+	opts.Recovery = policy
+
+	mode, ok := durabilityModes[*durability]
+	if !ok {
+		log.Printf("unknown sync mode: %s\n", *durability)
+		return
+	}
+	opts.Durability = mode
+	opts.SyncInterval = *syncInterval
+
+	index, ok := indexModes[*indexMode]
+	if !ok {
+		log.Printf("unknown index mode: %s\n", *indexMode)
+		return
+	}
+	opts.IndexMode = index
+	opts.ReadOnly = *readOnly
+	if *readOnly && *leader != "" {
+		log.Printf("read-only database can't follow the leader\n")
+		return
+	}
+
+	var oldKeys []string
+	if *oldKeyFiles != "" {
+		oldKeys = strings.Split(*oldKeyFiles, ",")
+	}
+	keys, err := datastore.LoadKeyring(*keyFile, oldKeys)
+	if err != nil {
+		log.Printf("cannot load encryption keys: %v\n", err)
+		return
+	}
+	opts.Keyring = keys
+
+	merge, err := createMergePolicy()
+	if err != nil {
+		log.Printf("bad merge policy: %v\n", err)
+		return
+	}
+	opts.BloomFilterRate = *bloomRate
+	opts.MergePolicy = merge
+	opts.AutoMergeEnabled = merge != nil
+
+	if *restore != "" {
+		if err := restoreBackup(*restore, *dir); err != nil {
+			log.Printf("cannot restore backup: %v\n", err)
+			return
+		}
+	}
+
 	h := new(http.ServeMux)
-	db, err := datastore.NewDb(*dir)
+	db, err := datastore.NewDbWithOptions(*dir, opts)
 	if err != nil {
 		log.Printf("cannot create database instance: %v\n", err)
 		return
 	}
 
+	var follower *replication.Follower
+	if *leader != "" {
+		follower = replication.NewFollower(db, *leader)
+		follower.Start()
+	}
+	replication.Register(h, db, follower)
+
+	// followers accept writes only after they are promoted
+	writable := func(rw http.ResponseWriter) bool {
+		if *readOnly {
+			log.Printf("write request to read-only database")
+			rw.WriteHeader(http.StatusForbidden)
+			return false
+		}
+		if follower != nil && follower.Following() {
+			log.Printf("write request to follower of %s", *leader)
+			rw.WriteHeader(http.StatusForbidden)
+			return false
+		}
+		return true
+	}
+
 	h.HandleFunc("/db/", func(rw http.ResponseWriter, r *http.Request) {
 		rw.Header().Set("Content-Type", "application/json")
-		key := strings.TrimPrefix(r.URL.Path, "/db/")
-		if r.Method == http.MethodGet {
-			value, err := db.Get(key)
+		ks, key, err := resolveKey(db, strings.TrimPrefix(r.URL.EscapedPath(), "/db/"))
+		if err == datastore.ErrBucketNotFound {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("bad key path %s: %v", r.URL.Path, err)
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if r.Method == http.MethodGet && key == "" {
+			// keys are listed in pages: the next page starts after the last key of the previous one
+			query := r.URL.Query()
+			limit := 0
+			if l := query.Get("limit"); l != "" {
+				var err error
+				limit, err = strconv.Atoi(l)
+				if err != nil || limit < 0 {
+					log.Printf("bad keys limit: %s", l)
+					rw.WriteHeader(http.StatusBadRequest)
+					return
+				}
+			}
+
+			keys, err := ks.Scan(query.Get("prefix"), query.Get("start"), limit)
+			if err != nil {
+				log.Printf("cannot list keys: %v\n", err)
+				rw.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			if keys == nil {
+				keys = []string{}
+			}
+
+			err = json.NewEncoder(rw).Encode(models.DbKeysResponse{Keys: keys})
+			if err != nil {
+				log.Printf("cannot write response to rw: %v", err)
+			}
+		} else if r.Method == http.MethodGet && r.Header.Get("Accept") == streamType {
+			// raw values are streamed right from the segment file
+			value, err := ks.GetStreamContext(r.Context(), key)
+			if err == datastore.ErrNotFound {
+				log.Printf("cannot find record: %v\n", err)
+				rw.WriteHeader(http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				log.Printf("cannot get record: %v\n", err)
+				rw.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			defer value.Close()
+
+			rw.Header().Set("Content-Type", streamType)
+			rw.Header().Set("Content-Length", strconv.FormatInt(value.Size(), 10))
+			rw.Header().Set("ETag", etag(value.Version()))
+			if _, err := io.Copy(rw, value); err != nil {
+				// the status is already sent, the client sees the response shorter than its length
+				log.Printf("cannot write response to rw: %v", err)
+			}
+		} else if r.Method == http.MethodGet {
+			value, version, err := ks.GetWithVersionContext(r.Context(), key)
 			if err == datastore.ErrNotFound || value == "" {
 				log.Printf("cannot find record: %v\n", err)
 				rw.WriteHeader(http.StatusNotFound)
@@ -46,12 +232,20 @@ func main() {
 				rw.WriteHeader(http.StatusInternalServerError)
 				return
 			}
+			rw.Header().Set("ETag", etag(version))
 			_, err = rw.Write(b)
 			if err != nil {
 				log.Printf("cannot write response to rw: %v", err)
 				return
 			}
 		} else if r.Method == http.MethodPost {
+			if !writable(rw) {
+				return
+			}
+			if r.Header.Get("Content-Type") == streamType {
+				putStream(rw, r, ks, key)
+				return
+			}
 			body, err := ioutil.ReadAll(r.Body)
 			defer r.Body.Close()
 
@@ -69,7 +263,63 @@ func main() {
 				return
 			}
 
-			err = db.Put(key, req.Value)
+			if req.TTL < 0 {
+				log.Printf("negative ttl: %d", req.TTL)
+				rw.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			// atomic operations change the current value instead of replacing it
+			if op := r.URL.Query().Get("op"); op != "" {
+				if req.TTL != 0 || r.Header.Get("If-Match") != "" || r.Header.Get("If-None-Match") != "" {
+					log.Printf("%s operation with ttl or condition", op)
+					rw.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				applyOperation(r.Context(), rw, ks, key, op, req)
+				return
+			}
+
+			// If-Match makes the put conditional on the version of the current value, If-None-Match: * - on its absence
+			conditional := true
+			var expectedVersion uint64
+			if match := r.Header.Get("If-Match"); match != "" {
+				expectedVersion, err = parseETag(match)
+			} else if r.Header.Get("If-None-Match") == "*" {
+				expectedVersion = 0
+			} else {
+				conditional = false
+			}
+			if err != nil || (conditional && req.TTL > 0) {
+				log.Printf("bad conditional put request: %v", err)
+				rw.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			if conditional {
+				var version uint64
+				version, err = ks.CompareAndSwapContext(r.Context(), key, expectedVersion, req.Value)
+				if err == datastore.ErrVersionMismatch {
+					rw.WriteHeader(http.StatusPreconditionFailed)
+					return
+				}
+				if err == nil {
+					rw.Header().Set("ETag", etag(version))
+				}
+			} else if req.TTL > 0 {
+				err = ks.PutWithTTLContext(r.Context(), key, req.Value, time.Duration(req.TTL)*time.Second)
+			} else {
+				err = ks.PutContext(r.Context(), key, req.Value)
+			}
+			if err == datastore.ErrBucketNotFound {
+				// the bucket has been dropped meanwhile
+				rw.WriteHeader(http.StatusNotFound)
+				return
+			}
+			if err == datastore.ErrReservedKey {
+				rw.WriteHeader(http.StatusBadRequest)
+				return
+			}
 			if err != nil {
 				log.Printf("cannot put value to database: %v", err)
 				rw.WriteHeader(http.StatusInternalServerError)
@@ -77,10 +327,478 @@ func main() {
 			}
 
 			rw.WriteHeader(http.StatusOK)
+		} else if r.Method == http.MethodDelete {
+			if !writable(rw) {
+				return
+			}
+			err := ks.DeleteContext(r.Context(), key)
+			if err == datastore.ErrBucketNotFound {
+				// the bucket has been dropped meanwhile
+				rw.WriteHeader(http.StatusNotFound)
+				return
+			}
+			if err == datastore.ErrReservedKey {
+				rw.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			if err != nil {
+				log.Printf("cannot delete value from database: %v", err)
+				rw.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			rw.WriteHeader(http.StatusOK)
+		}
+	})
+
+	h.HandleFunc("/buckets/", func(rw http.ResponseWriter, r *http.Request) {
+		name, err := url.PathUnescape(strings.TrimPrefix(r.URL.EscapedPath(), "/buckets/"))
+		if err != nil {
+			log.Printf("bad bucket name: %v", err)
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if r.Method == http.MethodGet && name == "" {
+			buckets, err := db.Buckets()
+			if err != nil {
+				log.Printf("cannot list buckets: %v", err)
+				rw.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			if buckets == nil {
+				buckets = []string{}
+			}
+
+			rw.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(rw).Encode(models.DbBucketsResponse{Buckets: buckets}); err != nil {
+				log.Printf("cannot write response to rw: %v", err)
+			}
+		} else if r.Method == http.MethodPost && name != "" {
+			if !writable(rw) {
+				return
+			}
+			if _, err := db.CreateBucket(name); err != nil {
+				log.Printf("cannot create bucket: %v", err)
+				rw.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			rw.WriteHeader(http.StatusOK)
+		} else if r.Method == http.MethodDelete && name != "" {
+			if !writable(rw) {
+				return
+			}
+			err := db.DropBucket(name)
+			if err == datastore.ErrBucketNotFound {
+				rw.WriteHeader(http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				log.Printf("cannot drop bucket: %v", err)
+				rw.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			rw.WriteHeader(http.StatusOK)
+		} else {
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	})
+
+	h.HandleFunc("/indexes/", func(rw http.ResponseWriter, r *http.Request) {
+		// indexes of a bucket are addressed as /indexes/{bucket}/{path}
+		bucket, path, err := resolveIndex(db, strings.TrimPrefix(r.URL.EscapedPath(), "/indexes/"))
+		if err == datastore.ErrBucketNotFound {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("bad index path %s: %v", r.URL.Path, err)
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if r.Method == http.MethodGet && path == "" {
+			paths, err := bucket.Indexes()
+			if err != nil {
+				log.Printf("cannot list indexes: %v", err)
+				rw.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			if paths == nil {
+				paths = []string{}
+			}
+
+			rw.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(rw).Encode(models.DbIndexesResponse{Indexes: paths}); err != nil {
+				log.Printf("cannot write response to rw: %v", err)
+			}
+			return
+		}
+		if path == "" || r.Method != http.MethodPost && r.Method != http.MethodDelete {
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !writable(rw) {
+			return
+		}
+
+		if r.Method == http.MethodPost {
+			err = bucket.CreateIndex(path)
+		} else {
+			err = bucket.DropIndex(path)
+		}
+		if err == datastore.ErrBucketNotFound || err == datastore.ErrNoIndex {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("cannot change index %s: %v", path, err)
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		rw.WriteHeader(http.StatusOK)
+	})
+
+	h.HandleFunc("/query/", func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		name, err := url.PathUnescape(strings.TrimPrefix(r.URL.EscapedPath(), "/query/"))
+		if err != nil {
+			log.Printf("bad bucket name: %v", err)
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		bucket, err := db.Bucket(name)
+		if err == datastore.ErrBucketNotFound {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("cannot get bucket: %v", err)
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		// the field either equals eq or is within min and max, both are optional
+		query := r.URL.Query()
+		field := query.Get("field")
+		var keys []string
+		if _, ok := query["eq"]; ok {
+			keys, err = bucket.Find(field, fieldValue(query.Get("eq")))
+		} else {
+			var bounds [2]interface{}
+			for i, name := range []string{"min", "max"} {
+				if _, ok := query[name]; ok {
+					bounds[i] = fieldValue(query.Get(name))
+				}
+			}
+			keys, err = bucket.FindRange(field, bounds[0], bounds[1])
+		}
+		if err != nil {
+			log.Printf("cannot query bucket %s: %v", name, err)
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if keys == nil {
+			keys = []string{}
+		}
+
+		rw.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(rw).Encode(models.DbKeysResponse{Keys: keys}); err != nil {
+			log.Printf("cannot write response to rw: %v", err)
+		}
+	})
+
+	h.HandleFunc("/batch", func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !writable(rw) {
+			return
+		}
+
+		var req models.DbBatchRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+		defer r.Body.Close()
+		if err != nil {
+			log.Printf("cannot read request body: %v", err)
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		b := datastore.NewWriteBatch()
+		for _, op := range req.Operations {
+			if op.Key == "" {
+				log.Printf("batch operation without key")
+				rw.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			if op.Delete {
+				b.Delete(op.Key)
+			} else {
+				b.Put(op.Key, op.Value)
+			}
+		}
+
+		err = db.WriteContext(r.Context(), b)
+		if err == datastore.ErrReservedKey {
+			log.Printf("batch operation with reserved key")
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			log.Printf("cannot write batch to database: %v", err)
+			rw.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		rw.WriteHeader(http.StatusOK)
+	})
+
+	h.HandleFunc("/admin/backup", func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		rw.Header().Set("Content-Type", "application/x-tar")
+		rw.Header().Set("Content-Disposition", "attachment; filename=\"backup.tar\"")
+		if err := db.Backup(rw); err != nil {
+			// the status is already sent, so the client sees a broken archive which won't be restored
+			log.Printf("cannot write backup: %v", err)
+		}
+	})
+
+	h.HandleFunc("/admin/merge", func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		err := db.Merge()
+		if err == datastore.ErrReadOnly {
+			rw.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if err != nil {
+			log.Printf("cannot merge segments: %v", err)
+			rw.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		rw.WriteHeader(http.StatusOK)
+	})
+
+	h.HandleFunc("/admin/stats", func(rw http.ResponseWriter, r *http.Request) {
+		stats, err := db.Stats()
+		if err != nil {
+			log.Printf("cannot get stats: %v", err)
+			rw.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		rw.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(rw).Encode(stats); err != nil {
+			log.Printf("cannot write stats: %v", err)
 		}
 	})
 
 	server := httptools.CreateServer(*port, h)
 	server.Start()
 	signal.WaitForTerminationSignal()
+
+	// the puts in flight are written and the lock is released before exit, later requests fail
+	if err := db.Close(); err != nil {
+		log.Printf("cannot close database: %v", err)
+	}
+}
+
+// keyspace is either the whole database or one of its buckets
+type keyspace interface {
+	GetWithVersionContext(ctx context.Context, key string) (string, uint64, error)
+	GetStreamContext(ctx context.Context, key string) (*datastore.ValueReader, error)
+	PutContext(ctx context.Context, key, value string) error
+	PutWithTTLContext(ctx context.Context, key, value string, ttl time.Duration) error
+	PutStreamContext(ctx context.Context, key string, r io.Reader, size int64) error
+	CompareAndSwapContext(ctx context.Context, key string, expectedVersion uint64, value string) (uint64, error)
+	DeleteContext(ctx context.Context, key string) error
+	IncrementContext(ctx context.Context, key string, delta int64) (int64, error)
+	AppendContext(ctx context.Context, key, suffix string) error
+	Scan(prefix, start string, limit int) ([]string, error)
+}
+
+// resolveKey splits the escaped path into the keyspace and the key: the keys of buckets are addressed as
+// bucket/key. The path whose first part isn't a bucket is the flat key with slashes, as it was before buckets,
+// and the flat key which starts with the name of a bucket has its slashes escaped as %2F
+func resolveKey(db *datastore.Db, path string) (keyspace, string, error) {
+	var ks keyspace = db
+	if i := strings.Index(path, "/"); i >= 0 {
+		name, err := url.PathUnescape(path[:i])
+		if err != nil {
+			return nil, "", err
+		}
+		// the names which can't be buckets are parts of the flat keys too
+		if name != "" && !strings.Contains(name, "\x00") {
+			bucket, err := db.Bucket(name)
+			if err == nil {
+				ks, path = bucket, path[i+1:]
+			} else if err != datastore.ErrBucketNotFound {
+				return nil, "", err
+			}
+		}
+	}
+	key, err := url.PathUnescape(path)
+	return ks, key, err
+}
+
+func resolveIndex(db *datastore.Db, path string) (*datastore.Bucket, string, error) {
+	parts := strings.SplitN(path, "/", 2)
+	name, err := url.PathUnescape(parts[0])
+	if err != nil {
+		return nil, "", err
+	}
+	bucket, err := db.Bucket(name)
+	if err != nil || len(parts) == 1 {
+		return bucket, "", err
+	}
+	path, err = url.PathUnescape(parts[1])
+	return bucket, path, err
+}
+
+// fieldValue parses the json scalar of the query, the values which are not json are taken as strings
+func fieldValue(param string) interface{} {
+	var value interface{}
+	if err := json.Unmarshal([]byte(param), &value); err != nil {
+		return param
+	}
+	return value
+}
+
+// applyOperation increments or appends to the value of the key, the incremented value is returned
+func applyOperation(ctx context.Context, rw http.ResponseWriter, ks keyspace, key, op string, req models.DbRequest) {
+	var (
+		res models.DbResponse
+		err error
+	)
+	switch op {
+	case "increment":
+		var n int64
+		n, err = ks.IncrementContext(ctx, key, req.Delta)
+		res = models.DbResponse{Key: key, Value: strconv.FormatInt(n, 10)}
+	case "append":
+		err = ks.AppendContext(ctx, key, req.Value)
+	default:
+		log.Printf("unknown operation: %s", op)
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err == datastore.ErrNotInteger || err == datastore.ErrOverflow {
+		rw.WriteHeader(http.StatusConflict)
+		return
+	}
+	if err == datastore.ErrBucketNotFound {
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("cannot apply %s to database: %v", op, err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if op == "increment" {
+		if err := json.NewEncoder(rw).Encode(res); err != nil {
+			log.Printf("cannot write response to rw: %v", err)
+		}
+		return
+	}
+	rw.WriteHeader(http.StatusOK)
+}
+
+// putStream puts the raw request body as the value without reading it into memory
+func putStream(rw http.ResponseWriter, r *http.Request, ks keyspace, key string) {
+	defer r.Body.Close()
+	if r.ContentLength < 0 {
+		log.Printf("streamed value without length")
+		rw.WriteHeader(http.StatusLengthRequired)
+		return
+	}
+	if r.Header.Get("If-Match") != "" || r.Header.Get("If-None-Match") != "" {
+		log.Printf("conditional put of streamed value")
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	err := ks.PutStreamContext(r.Context(), key, r.Body, r.ContentLength)
+	if err == datastore.ErrValueTooLarge {
+		rw.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err == datastore.ErrBucketNotFound {
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		log.Printf("cannot read request body: %v", err)
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Printf("cannot put value to database: %v", err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	rw.WriteHeader(http.StatusOK)
+}
+
+func createMergePolicy() (datastore.MergePolicy, error) {
+	var policy datastore.MergePolicy
+	switch *mergePolicy {
+	case "count":
+		policy = datastore.SegmentCountPolicy{MaxSegments: *mergeSegments}
+	case "garbage":
+		policy = datastore.GarbageRatioPolicy{Ratio: *mergeGarbageRatio}
+	case "tiered":
+		policy = datastore.SizeTieredPolicy{MinSegments: *mergeSegments, Ratio: *mergeSizeRatio}
+	case "none":
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unknown merge policy %s", *mergePolicy)
+	}
+
+	if *mergeWindow == "" {
+		return policy, nil
+	}
+	bounds := strings.Split(*mergeWindow, "-")
+	if len(bounds) != 2 {
+		return nil, fmt.Errorf("bad merge window %s", *mergeWindow)
+	}
+	var window [2]time.Duration
+	for i, bound := range bounds {
+		t, err := time.Parse("15:04", strings.TrimSpace(bound))
+		if err != nil {
+			return nil, err
+		}
+		window[i] = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	}
+	return datastore.ScheduledPolicy{Start: window[0], End: window[1], Policy: policy}, nil
+}
+
+func restoreBackup(path, dir string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return datastore.Restore(f, dir)
+}
+
+func etag(version uint64) string {
+	return fmt.Sprintf("\"%d\"", version)
+}
+
+func parseETag(tag string) (uint64, error) {
+	tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+	return strconv.ParseUint(strings.Trim(tag, "\""), 10, 64)
 }
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/AlmostGreatBand/KPI2-2/datastore"
+)
+
+const usage = `usage: dbtool [-key-file <file>] [-old-key-files <files>] <command> <path>
+
+Works with the files of a stopped db server. Commands:
+  list <dir>          list segments with their record and tombstone counts
+  dump <segment>      print records of the segment as JSON, one per line
+  verify <dir>        check that every record of every segment decodes
+  compact <dir>       merge all segments into one
+  truncate <segment>  cut the segment at its first corrupted record
+  upgrade <dir>       rewrite the segments of older formats in the current one
+
+Encrypted values are dumped and verified with the same keys the server uses, the key is taken
+from ` + datastore.KeyEnv + ` when -key-file is not set. Compaction without the key copies them as they are.
+`
+
+type dumpedRecord struct {
+	Offset    int64      `json:"offset"`
+	Key       string     `json:"key"`
+	Value     string     `json:"value,omitempty"`
+	Deleted   bool       `json:"deleted,omitempty"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	Version   uint64     `json:"version"`
+	Batch     bool       `json:"batch,omitempty"`
+}
+
+var keyFile = flag.String("key-file", "", "file with the hex encoded key values are encrypted with")
+var oldKeyFiles = flag.String("old-key-files", "", "comma separated files with the previous keys")
+
+// keys are nil when the key is not given
+var keys *datastore.Keyring
+
+var commands = map[string]func(path string) error{
+	"list":     list,
+	"dump":     dump,
+	"verify":   verify,
+	"compact":  compact,
+	"truncate": truncate,
+	"upgrade":  upgrade,
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+	}
+	flag.Parse()
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	command, ok := commands[flag.Arg(0)]
+	if !ok {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var oldKeys []string
+	if *oldKeyFiles != "" {
+		oldKeys = strings.Split(*oldKeyFiles, ",")
+	}
+	var err error
+	if keys, err = datastore.LoadKeyring(*keyFile, oldKeys); err != nil {
+		log.Printf("cannot load encryption keys: %v", err)
+		os.Exit(1)
+	}
+	if err := command(flag.Arg(1)); err != nil {
+		log.Printf("%s: %v", flag.Arg(0), err)
+		os.Exit(1)
+	}
+}
+
+func list(dir string) error {
+	paths, err := datastore.SegmentFiles(dir)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SEGMENT\tFORMAT\tSIZE\tRECORDS\tTOMBSTONES\tCORRUPTED BYTES")
+	for _, path := range paths {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		format := "corrupted"
+		if version, err := datastore.SegmentFormat(path); err == nil {
+			format = strconv.Itoa(int(version))
+		}
+
+		records, tombstones := 0, 0
+		corruptions, err := datastore.ReadSegment(path, func(r datastore.Record) {
+			records++
+			if r.Deleted {
+				tombstones++
+			}
+		})
+		if err != nil {
+			return err
+		}
+		var corrupted int64
+		for _, c := range corruptions {
+			corrupted += c.Size
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t%d\n", filepath.Base(path), format, fi.Size(), records, tombstones, corrupted)
+	}
+	return w.Flush()
+}
+
+func dump(path string) error {
+	out := json.NewEncoder(os.Stdout)
+	var writeErr error
+	corruptions, err := datastore.ReadSegment(path, func(r datastore.Record) {
+		if writeErr != nil {
+			return
+		}
+		value, err := keys.Decrypt(r)
+		if err == datastore.ErrNoKey {
+			writeErr = fmt.Errorf("values are encrypted, the key is required: %w", err)
+			return
+		}
+		if err != nil {
+			writeErr = fmt.Errorf("record at offset %d: %w", r.Offset, err)
+			return
+		}
+		record := dumpedRecord{
+			Offset:  r.Offset,
+			Key:     r.Key,
+			Value:   value,
+			Deleted: r.Deleted,
+			Version: r.Version,
+			Batch:   r.Batch,
+		}
+		if r.ExpiresAt != 0 {
+			expiresAt := time.Unix(0, r.ExpiresAt).UTC()
+			record.ExpiresAt = &expiresAt
+		}
+		writeErr = out.Encode(record)
+	})
+	if err != nil {
+		return err
+	}
+	if writeErr != nil {
+		return writeErr
+	}
+	for _, c := range corruptions {
+		log.Printf("corrupted data in %v", c)
+	}
+	return nil
+}
+
+func verify(dir string) error {
+	paths, err := datastore.SegmentFiles(dir)
+	if err != nil {
+		return err
+	}
+
+	// without the key only the checksums of encrypted values are checked
+	damaged := 0
+	for _, path := range paths {
+		undecrypted := 0
+		corruptions, err := datastore.ReadSegment(path, func(r datastore.Record) {
+			if keys == nil {
+				return
+			}
+			if _, err := keys.Decrypt(r); err != nil {
+				fmt.Printf("%s: record at offset %d: %v\n", path, r.Offset, err)
+				undecrypted++
+			}
+		})
+		if err != nil {
+			return err
+		}
+		for _, c := range corruptions {
+			fmt.Println(c)
+		}
+		if len(corruptions) > 0 || undecrypted > 0 {
+			damaged++
+		}
+	}
+	if damaged > 0 {
+		return fmt.Errorf("%d of %d segments are corrupted", damaged, len(paths))
+	}
+	fmt.Printf("%d segments are ok\n", len(paths))
+	return nil
+}
+
+func compact(dir string) error {
+	before, err := datastore.SegmentFiles(dir)
+	if err != nil {
+		return err
+	}
+	opts := datastore.DefaultOptions()
+	opts.Keyring = keys
+	if err := datastore.Compact(dir, opts); err != nil {
+		return err
+	}
+	after, err := datastore.SegmentFiles(dir)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d segments before compaction, %d after\n", len(before), len(after))
+	return nil
+}
+
+func truncate(path string) error {
+	removed, err := datastore.TruncateSegment(path)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d bytes removed from %s\n", removed, path)
+	return nil
+}
+
+func upgrade(dir string) error {
+	upgraded, err := datastore.Upgrade(dir)
+	for _, path := range upgraded {
+		fmt.Printf("%s is upgraded to format %d\n", path, datastore.FormatVersion)
+	}
+	if err != nil {
+		return err
+	}
+	if len(upgraded) == 0 {
+		fmt.Printf("all segments have format %d\n", datastore.FormatVersion)
+	}
+	return nil
+}
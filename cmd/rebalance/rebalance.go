@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	models "github.com/AlmostGreatBand/KPI2-2/cmd/common"
+	"github.com/AlmostGreatBand/KPI2-2/shard"
+)
+
+var from = flag.String("from", "", "comma separated db servers the keys are sharded between now")
+var to = flag.String("to", "", "comma separated db servers the keys have to be sharded between")
+var virtualNodes = flag.Int("virtual-nodes", shard.DefaultVirtualNodes, "number of points every db server has on the hash ring")
+var pageSize = flag.Int("page", 100, "how many keys are listed at once")
+var dryRun = flag.Bool("dry-run", false, "only report the keys which have to be moved")
+
+var client = &http.Client{Timeout: 10 * time.Second}
+
+// Rebalance moves keys between db servers after a shard is added or removed. Every key of the old servers is checked
+// against the new ring, and the keys which belong to another server are copied there and deleted from the old one.
+// Keys are moved without their TTL, and writes to the moved keys should be stopped until the servers are rebalanced
+func main() {
+	flag.Parse()
+
+	oldNodes := shard.ParseNodes(*from)
+	newNodes := shard.ParseNodes(*to)
+	if len(oldNodes) == 0 || len(newNodes) == 0 {
+		log.Printf("both -from and -to db servers have to be set")
+		os.Exit(2)
+	}
+	ring := shard.NewRing(newNodes, *virtualNodes)
+
+	moved, failed := 0, 0
+	for _, node := range oldNodes {
+		start := ""
+		for {
+			keys, err := listKeys(node, start)
+			if err != nil {
+				log.Printf("cannot list keys of %s: %v", node, err)
+				failed++
+				break
+			}
+
+			for _, key := range keys {
+				target := ring.Node(key)
+				if target == node {
+					continue
+				}
+				if *dryRun {
+					log.Printf("%s: %s -> %s", key, node, target)
+					moved++
+					continue
+				}
+				if err := move(key, node, target); err != nil {
+					log.Printf("cannot move %s from %s to %s: %v", key, node, target, err)
+					failed++
+					continue
+				}
+				moved++
+			}
+
+			if len(keys) < *pageSize {
+				break
+			}
+			// the start key is inclusive, so the next page begins right after the last listed key
+			start = keys[len(keys)-1] + "\x00"
+		}
+	}
+
+	log.Printf("moved %d keys, %d failures", moved, failed)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+func listKeys(node, start string) ([]string, error) {
+	query := url.Values{}
+	query.Set("start", start)
+	query.Set("limit", fmt.Sprint(*pageSize))
+	resp, err := client.Get(fmt.Sprintf("http://%s/db/?%s", node, query.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var res models.DbKeysResponse
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, err
+	}
+	return res.Keys, nil
+}
+
+func move(key, source, target string) error {
+	resp, err := client.Get(shard.KeyUrl(source, key))
+	if err != nil {
+		return err
+	}
+	var value models.DbResponse
+	err = json.NewDecoder(resp.Body).Decode(&value)
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		// the key is deleted or expired after it was listed, nothing to move
+		return nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s of %s", resp.Status, source)
+	}
+	if err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(models.DbRequest{Value: value.Value})
+	if err != nil {
+		return err
+	}
+	resp, err = client.Post(shard.KeyUrl(target, key), "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s of %s", resp.Status, target)
+	}
+
+	// the key is deleted from the old server only after the new one has it
+	req, err := http.NewRequest(http.MethodDelete, shard.KeyUrl(source, key), nil)
+	if err != nil {
+		return err
+	}
+	resp, err = client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s of %s", resp.Status, source)
+	}
+	return nil
+}
@@ -13,15 +13,26 @@ import (
 	"time"
 
 	"github.com/AlmostGreatBand/KPI2-2/httptools"
+	"github.com/AlmostGreatBand/KPI2-2/shard"
 	"github.com/AlmostGreatBand/KPI2-2/signal"
 )
 
 var port = flag.Int("port", 8080, "server port")
+var dbServers = flag.String("db-servers", "dbserver:8080", "comma separated db server addresses, keys are sharded between them")
+var virtualNodes = flag.Int("virtual-nodes", shard.DefaultVirtualNodes, "number of points every db server has on the hash ring")
 
 const confResponseDelaySec = "CONF_RESPONSE_DELAY_SEC"
 const confHealthFailure = "CONF_HEALTH_FAILURE"
 
 func main() {
+	flag.Parse()
+
+	router, err := shard.NewRouter(*dbServers, *virtualNodes)
+	if err != nil {
+		log.Printf("cannot create db router: %v", err)
+		return
+	}
+
 	h := new(http.ServeMux)
 
 	h.HandleFunc("/health", func(rw http.ResponseWriter, r *http.Request) {
@@ -52,7 +63,7 @@ func main() {
 		report.Process(r)
 
 		key := keys[0]
-		resp, err := http.DefaultClient.Get("http://dbserver:8080/db/" + key)
+		resp, err := http.DefaultClient.Get(router.Url(key))
 		if err != nil {
 			log.Printf("Can't get data from dbserver: %v\n", err)
 			rw.WriteHeader(http.StatusInternalServerError)
@@ -87,7 +98,7 @@ func main() {
 	}
 
 	_, err = http.DefaultClient.Post(
-		"http://dbserver:8080/db/agb",
+		router.Url("agb"),
 		"application/json",
 		bytes.NewBuffer(body),
 	)
@@ -0,0 +1,202 @@
+package datastore
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// the manifest goes first in the archive and lists all the segments, since a tar cut at a file boundary
+// can't be told apart from a complete one
+const backupManifest = "backup-manifest"
+
+type backupFile struct {
+	name string
+	file *os.File
+	size int64
+}
+
+// Backup writes a tar archive of all the segments as they are at the moment of the call. Segment files are opened
+// under the lock, so neither sealing of the active segment nor merge can change the set of files, and the active
+// segment is cut at the last indexed record, so the writes which happen while the archive is written are not included
+func (db *Db) Backup(w io.Writer) error {
+	db.mux.RLock()
+	var files []backupFile
+	for i := len(db.segments) - 1; i >= 0; i-- {
+		s := db.segments[i]
+		f, err := s.openFile()
+		if err != nil {
+			db.mux.RUnlock()
+			closeBackupFiles(files)
+			return err
+		}
+		files = append(files, backupFile{name: filepath.Base(s.path), file: f, size: s.offset})
+	}
+	db.mux.RUnlock()
+	defer closeBackupFiles(files)
+
+	tw := tar.NewWriter(w)
+	modTime := time.Now()
+
+	var manifest bytes.Buffer
+	for _, f := range files {
+		fmt.Fprintf(&manifest, "%s %d\n", f.name, f.size)
+	}
+	header := &tar.Header{
+		Name:    backupManifest,
+		Mode:    0o600,
+		Size:    int64(manifest.Len()),
+		ModTime: modTime,
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	if _, err := tw.Write(manifest.Bytes()); err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		header := &tar.Header{
+			Name:    f.name,
+			Mode:    0o600,
+			Size:    f.size,
+			ModTime: modTime,
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, io.NewSectionReader(f.file, 0, f.size)); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+func closeBackupFiles(files []backupFile) {
+	for _, f := range files {
+		f.file.Close()
+	}
+}
+
+// Restore extracts the archive written by Backup to dir, which must not contain any segments. Files are written
+// with temporary names and renamed only when the whole archive is read, so a broken archive leaves dir untouched
+func Restore(r io.Reader, dir string) error {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	lock, err := lockDir(dir)
+	if err != nil {
+		return err
+	}
+	defer lock.release()
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if isSegmentFile(f.Name()) {
+			return fmt.Errorf("cannot restore to %s: it already contains %s", dir, f.Name())
+		}
+	}
+
+	var restored []string
+	cleanup := func() {
+		for _, name := range restored {
+			os.Remove(filepath.Join(dir, name+".tmp"))
+		}
+	}
+
+	tr := tar.NewReader(r)
+	expected, err := readManifest(tr)
+	if err != nil {
+		return err
+	}
+
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			cleanup()
+			return err
+		}
+		size, ok := expected[header.Name]
+		if !ok || size != header.Size {
+			cleanup()
+			return fmt.Errorf("%s is not in backup manifest: %w", header.Name, ErrCorrupted)
+		}
+		delete(expected, header.Name)
+		if header.Typeflag != tar.TypeReg || filepath.Base(header.Name) != header.Name || !isSegmentFile(header.Name) {
+			cleanup()
+			return fmt.Errorf("unexpected file %s in backup: %w", header.Name, ErrCorrupted)
+		}
+
+		restored = append(restored, header.Name)
+		if err := restoreFile(tr, filepath.Join(dir, header.Name+".tmp")); err != nil {
+			cleanup()
+			return err
+		}
+	}
+
+	if len(expected) > 0 {
+		cleanup()
+		return fmt.Errorf("backup is incomplete, %d segments are missing: %w", len(expected), ErrCorrupted)
+	}
+
+	for _, name := range restored {
+		path := filepath.Join(dir, name)
+		if err := os.Rename(path+".tmp", path); err != nil {
+			cleanup()
+			return err
+		}
+	}
+	return nil
+}
+
+func readManifest(tr *tar.Reader) (map[string]int64, error) {
+	header, err := tr.Next()
+	if err != nil || header.Name != backupManifest {
+		return nil, fmt.Errorf("backup has no manifest: %w", ErrCorrupted)
+	}
+	data, err := ioutil.ReadAll(tr)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make(map[string]int64)
+	for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+		var (
+			name string
+			size int64
+		)
+		if _, err := fmt.Sscanf(line, "%s %d", &name, &size); err != nil {
+			return nil, fmt.Errorf("bad backup manifest line %q: %w", line, ErrCorrupted)
+		}
+		files[name] = size
+	}
+	return files, nil
+}
+
+func restoreFile(r io.Reader, path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
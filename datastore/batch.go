@@ -0,0 +1,105 @@
+package datastore
+
+import (
+	"encoding/binary"
+)
+
+// batch is stored as a single record, so its checksum covers all the operations and recover applies either all of
+// them or none: size | key size set to batchMarker | records count | records | crc32.
+// Inner records are complete records themselves, so the index points right to them and they are read as usual
+const batchMarker = -1
+const batchHeaderSize = 12
+
+// WriteBatch groups puts and deletes which are applied atomically by Db.Write
+type WriteBatch struct {
+	entries []*entry
+}
+
+func NewWriteBatch() *WriteBatch {
+	return &WriteBatch{}
+}
+
+func (b *WriteBatch) Put(key, value string) {
+	b.entries = append(b.entries, &entry{key: key, value: value})
+}
+
+func (b *WriteBatch) Delete(key string) {
+	b.entries = append(b.entries, &entry{key: key, deleted: true})
+}
+
+func (b *WriteBatch) Len() int {
+	return len(b.entries)
+}
+
+// encodeBatch returns the batch record and positions of inner records relative to its start
+func encodeBatch(entries []*entry) ([]byte, []int64) {
+	records := make([][]byte, len(entries))
+	positions := make([]int64, len(entries))
+	size := batchHeaderSize + checksumSize
+	for i, e := range entries {
+		records[i] = e.encode()
+		positions[i] = int64(size - checksumSize)
+		size += len(records[i])
+	}
+
+	res := make([]byte, size)
+	binary.LittleEndian.PutUint32(res, uint32(size))
+	binary.LittleEndian.PutUint32(res[4:], uint32(batchMarker&0xffffffff))
+	binary.LittleEndian.PutUint32(res[8:], uint32(len(entries)))
+	for i, record := range records {
+		copy(res[positions[i]:], record)
+	}
+	putChecksum(res)
+	return res, positions
+}
+
+func isBatch(record []byte) bool {
+	return len(record) >= 8 && int32(binary.LittleEndian.Uint32(record[4:])) == batchMarker
+}
+
+// decodeRecord returns all the entries stored in a plain or batch record and their positions relative to its start
+func decodeRecord(record []byte) ([]*entry, []int64, error) {
+	if !isBatch(record) {
+		e := new(entry)
+		err := e.Decode(record)
+		if err == ErrItemDeleted {
+			e.deleted = true
+			err = nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		return []*entry{e}, []int64{0}, nil
+	}
+
+	if !validChecksum(record) {
+		return nil, nil, ErrCorrupted
+	}
+	count := int(binary.LittleEndian.Uint32(record[8:]))
+	body := len(record) - checksumSize
+	entries := make([]*entry, 0, count)
+	positions := make([]int64, 0, count)
+
+	pos := batchHeaderSize
+	for i := 0; i < count; i++ {
+		if pos+4 > body {
+			return nil, nil, ErrCorrupted
+		}
+		size := int(binary.LittleEndian.Uint32(record[pos:]))
+		if size < minRecordSize || pos+size > body || isBatch(record[pos:]) {
+			return nil, nil, ErrCorrupted
+		}
+
+		inner, _, err := decodeRecord(record[pos : pos+size])
+		if err != nil {
+			return nil, nil, err
+		}
+		entries = append(entries, inner[0])
+		positions = append(positions, int64(pos))
+		pos += size
+	}
+	if pos != body {
+		return nil, nil, ErrCorrupted
+	}
+	return entries, positions, nil
+}
@@ -0,0 +1,225 @@
+package datastore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"hash/fnv"
+	"io"
+	"log"
+	"math"
+	"os"
+)
+
+// bloom file stores the filter of a sealed segment next to it:
+// segment size | segment modification time | hash functions count | words count | words | crc32
+const bloomSuffix = ".bloom"
+const bloomHeaderSize = 24
+const defBloomFilterRate = 0.01
+
+var errStaleFilter = fmt.Errorf("bloom filter file does not match the segment")
+
+// bloomFilter tells for sure that a key is not in the segment, so the lookup of a missing key doesn't have
+// to touch the segment at all
+type bloomFilter struct {
+	bits []uint64
+	k    uint32
+}
+
+func newBloomFilter(n int, rate float64) *bloomFilter {
+	if n < 1 {
+		n = 1
+	}
+	m := math.Ceil(-float64(n) * math.Log(rate) / (math.Ln2 * math.Ln2))
+	k := math.Round(m / float64(n) * math.Ln2)
+	if k < 1 {
+		k = 1
+	}
+	return &bloomFilter{
+		bits: make([]uint64, int(math.Ceil(m/64))),
+		k:    uint32(k),
+	}
+}
+
+// positions of the key bits are derived from two halves of one hash
+func (f *bloomFilter) hashes(key string) (uint32, uint32) {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	sum := h.Sum64()
+	return uint32(sum), uint32(sum >> 32)
+}
+
+func (f *bloomFilter) add(key string) {
+	h1, h2 := f.hashes(key)
+	m := uint64(len(f.bits)) * 64
+	for i := uint32(0); i < f.k; i++ {
+		bit := (uint64(h1) + uint64(i)*uint64(h2)) % m
+		f.bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+func (f *bloomFilter) mayContain(key string) bool {
+	h1, h2 := f.hashes(key)
+	m := uint64(len(f.bits)) * 64
+	for i := uint32(0); i < f.k; i++ {
+		bit := (uint64(h1) + uint64(i)*uint64(h2)) % m
+		if f.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *segment) bloomPath() string {
+	return s.path + bloomSuffix
+}
+
+// buildFilter creates the filter from the index, tombstones are added too, since they have to stop the lookup
+func (s *segment) buildFilter(rate float64) error {
+	f := newBloomFilter(s.keyCount(), rate)
+	if s.disk == nil {
+		for key := range s.index {
+			f.add(key)
+		}
+		s.filter = f
+		return nil
+	}
+
+	c, err := s.cursor()
+	if err != nil {
+		return err
+	}
+	defer c.close()
+	for {
+		e, ok, err := c.next()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+		f.add(e.key)
+	}
+	s.filter = f
+	return nil
+}
+
+// initFilter loads the filter of the sealed segment, or builds it when there is no suitable one and saves it
+// when save is set
+func (s *segment) initFilter(rate float64, save bool) {
+	if err := s.loadFilter(rate); err == nil {
+		return
+	} else if !os.IsNotExist(err) {
+		log.Printf("cannot use bloom filter file of %s, building a new one: %v", s.path, err)
+	}
+
+	err := s.buildFilter(rate)
+	if err == nil && save {
+		err = s.writeFilter()
+	}
+	if err != nil {
+		log.Printf("cannot write bloom filter file of %s: %v", s.path, err)
+	}
+}
+
+func (s *segment) writeFilter() error {
+	fi, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := s.bloomPath() + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+
+	hash := crc32.NewIEEE()
+	out := bufio.NewWriterSize(io.MultiWriter(f, hash), bufSize)
+
+	var header [bloomHeaderSize]byte
+	binary.LittleEndian.PutUint64(header[:], uint64(fi.Size()))
+	binary.LittleEndian.PutUint64(header[8:], uint64(fi.ModTime().UnixNano()))
+	binary.LittleEndian.PutUint32(header[16:], s.filter.k)
+	binary.LittleEndian.PutUint32(header[20:], uint32(len(s.filter.bits)))
+	out.Write(header[:])
+
+	var buf [8]byte
+	for _, word := range s.filter.bits {
+		binary.LittleEndian.PutUint64(buf[:], word)
+		out.Write(buf[:])
+	}
+
+	err = out.Flush()
+	if err == nil {
+		binary.LittleEndian.PutUint32(buf[:], hash.Sum32())
+		_, err = f.Write(buf[:4])
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return os.Rename(tmpPath, s.bloomPath())
+}
+
+// loadFilter reads the filter saved for the segment, the filter is stale if it was built for a different rate
+func (s *segment) loadFilter(rate float64) error {
+	fi, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(s.bloomPath())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	hash := crc32.NewIEEE()
+	in := io.TeeReader(bufio.NewReaderSize(f, bufSize), hash)
+
+	var header [bloomHeaderSize]byte
+	if _, err := io.ReadFull(in, header[:]); err != nil {
+		return errStaleFilter
+	}
+	size := int64(binary.LittleEndian.Uint64(header[:]))
+	modTime := int64(binary.LittleEndian.Uint64(header[8:]))
+	if size != fi.Size() || modTime != fi.ModTime().UnixNano() {
+		return errStaleFilter
+	}
+
+	expected := newBloomFilter(s.keyCount(), rate)
+	k := binary.LittleEndian.Uint32(header[16:])
+	words := int(binary.LittleEndian.Uint32(header[20:]))
+	if k != expected.k || words != len(expected.bits) {
+		return errStaleFilter
+	}
+
+	var buf [8]byte
+	for i := range expected.bits {
+		if _, err := io.ReadFull(in, buf[:]); err != nil {
+			return errStaleFilter
+		}
+		expected.bits[i] = binary.LittleEndian.Uint64(buf[:])
+	}
+
+	sum := hash.Sum32()
+	if _, err := io.ReadFull(in, buf[:4]); err != nil || binary.LittleEndian.Uint32(buf[:]) != sum {
+		return errStaleFilter
+	}
+
+	s.filter = expected
+	return nil
+}
+
+func (s *segment) removeFilter() {
+	err := os.Remove(s.bloomPath())
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("cannot remove bloom filter file: %v", err)
+	}
+}
@@ -0,0 +1,30 @@
+package datastore
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestBloomFilter(t *testing.T) {
+	for _, rate := range []float64{0.1, 0.01, 0.001} {
+		f := newBloomFilter(10000, rate)
+		for i := 0; i < 10000; i++ {
+			f.add(fmt.Sprintf("key%d", i))
+		}
+		for i := 0; i < 10000; i++ {
+			if !f.mayContain(fmt.Sprintf("key%d", i)) {
+				t.Fatalf("Added key%d is not in the filter", i)
+			}
+		}
+
+		falsePositives := 0
+		for i := 0; i < 100000; i++ {
+			if f.mayContain(fmt.Sprintf("missing%d", i)) {
+				falsePositives++
+			}
+		}
+		if actual := float64(falsePositives) / 100000; actual > 2*rate {
+			t.Errorf("False positive rate %f is too far from %f", actual, rate)
+		}
+	}
+}
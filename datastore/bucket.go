@@ -0,0 +1,281 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// buckets share the segments with the flat keyspace: the keys of a bucket are stored as zero | bucket | zero | key,
+// and every bucket has the registry record zero | zero | bucket. Keys starting with zero are reserved for them,
+// so all of them are less than the keys of the flat keyspace
+const bucketPrefix = "\x00"
+const bucketRegistryPrefix = "\x00\x00"
+const userKeysStart = "\x01"
+
+var ErrBucketNotFound = fmt.Errorf("bucket does not exist")
+var ErrReservedKey = fmt.Errorf("keys starting with zero byte are reserved for buckets")
+
+// Bucket is a separate keyspace inside the database. Its writes fail with ErrBucketNotFound once it's dropped
+type Bucket struct {
+	db   *Db
+	name string
+}
+
+func checkKey(key string) error {
+	if strings.HasPrefix(key, bucketPrefix) {
+		return ErrReservedKey
+	}
+	return nil
+}
+
+func checkBucketName(name string) error {
+	if name == "" || strings.Contains(name, "\x00") {
+		return fmt.Errorf("bad bucket name %q", name)
+	}
+	return nil
+}
+
+// checkBucket is called by the put goroutine before the entries of the bucket are written
+func (db *Db) checkBucket(name string) error {
+	_, err := db.getEntry(bucketRegistryPrefix + name)
+	if err == ErrNotFound {
+		return ErrBucketNotFound
+	}
+	return err
+}
+
+// CreateBucket creates the bucket unless it already exists and returns it
+func (db *Db) CreateBucket(name string) (*Bucket, error) {
+	if err := checkBucketName(name); err != nil {
+		return nil, err
+	}
+	err := db.send(putEntry{prepare: func() ([]*entry, error) {
+		err := db.checkBucket(name)
+		if err == ErrBucketNotFound {
+			return []*entry{{key: bucketRegistryPrefix + name}}, nil
+		}
+		return nil, err
+	}})
+	if err != nil {
+		return nil, err
+	}
+	return &Bucket{db: db, name: name}, nil
+}
+
+// Bucket returns the existing bucket
+func (db *Db) Bucket(name string) (*Bucket, error) {
+	if err := checkBucketName(name); err != nil {
+		return nil, err
+	}
+	if err := db.checkBucket(name); err != nil {
+		return nil, err
+	}
+	return &Bucket{db: db, name: name}, nil
+}
+
+// Buckets returns the names of all the buckets in sorted order
+func (db *Db) Buckets() ([]string, error) {
+	keys, err := db.scan(bucketRegistryPrefix, "", 0)
+	if err != nil {
+		return nil, err
+	}
+	for i, key := range keys {
+		keys[i] = strings.TrimPrefix(key, bucketRegistryPrefix)
+	}
+	return keys, nil
+}
+
+// the number of keys of the dropped bucket deleted by a single batch
+var dropChunkSize = 1024
+
+// DropBucket deletes the bucket with all its keys. They are deleted by batches of tombstones, so merge reclaims
+// the space of the dropped bucket just like the one of deleted keys. The bucket is removed together with the last
+// batch, so the drop interrupted by a crash leaves the bucket with a part of its keys, and it may be dropped again
+func (db *Db) DropBucket(name string) error {
+	if err := checkBucketName(name); err != nil {
+		return err
+	}
+	prefix := bucketKey(name, "")
+	start := prefix
+	for {
+		dropped := false
+		err := db.send(putEntry{prepare: func() ([]*entry, error) {
+			if err := db.checkBucket(name); err != nil {
+				return nil, err
+			}
+			keys, err := db.scan(prefix, start, dropChunkSize)
+			if err != nil {
+				return nil, err
+			}
+			entries := make([]*entry, 0, len(keys)+1)
+			for _, key := range keys {
+				entries = append(entries, &entry{key: key, deleted: true})
+			}
+			if len(keys) == dropChunkSize {
+				start = keys[len(keys)-1] + "\x00"
+				return entries, nil
+			}
+			if start != prefix {
+				// the keys written between the batches may be behind them, so the bucket is scanned again
+				start = prefix
+				return entries, nil
+			}
+			// the writes to the bucket are checked by the put goroutine too, so none of them can come after the scan
+			dropped = true
+			return append(entries, &entry{key: bucketRegistryPrefix + name, deleted: true}), nil
+		}})
+		if err != nil || dropped {
+			return err
+		}
+	}
+}
+
+func bucketKey(bucket, key string) string {
+	return bucketPrefix + bucket + "\x00" + key
+}
+
+// splitBucketKey returns the bucket and the key inside it of the stored key
+func splitBucketKey(key string) (string, string, bool) {
+	if !strings.HasPrefix(key, bucketPrefix) || strings.HasPrefix(key, bucketRegistryPrefix) {
+		return "", "", false
+	}
+	end := strings.Index(key[1:], "\x00")
+	if end < 0 {
+		return "", "", false
+	}
+	return key[1 : end+1], key[end+2:], true
+}
+
+func (b *Bucket) Name() string {
+	return b.name
+}
+
+func (b *Bucket) key(key string) string {
+	return bucketKey(b.name, key)
+}
+
+func (b *Bucket) write(ctx context.Context, entries ...*entry) error {
+	return b.db.sendContext(ctx, putEntry{entries: entries, bucket: b.name})
+}
+
+func (b *Bucket) Get(key string) (string, error) {
+	return b.db.Get(b.key(key))
+}
+
+// GetContext is Get which fails with the ctx error once ctx is done
+func (b *Bucket) GetContext(ctx context.Context, key string) (string, error) {
+	return b.db.GetContext(ctx, b.key(key))
+}
+
+// GetWithVersion returns the value with the version of the write which has put it
+func (b *Bucket) GetWithVersion(key string) (string, uint64, error) {
+	return b.db.GetWithVersion(b.key(key))
+}
+
+// GetWithVersionContext is GetWithVersion which fails with the ctx error once ctx is done
+func (b *Bucket) GetWithVersionContext(ctx context.Context, key string) (string, uint64, error) {
+	return b.db.GetWithVersionContext(ctx, b.key(key))
+}
+
+// GetStream returns the reader of the value, which has to be closed
+func (b *Bucket) GetStream(key string) (*ValueReader, error) {
+	return b.db.GetStream(b.key(key))
+}
+
+// GetStreamContext is GetStream which fails with the ctx error once ctx is done
+func (b *Bucket) GetStreamContext(ctx context.Context, key string) (*ValueReader, error) {
+	return b.db.GetStreamContext(ctx, b.key(key))
+}
+
+func (b *Bucket) Put(key, value string) error {
+	return b.PutContext(context.Background(), key, value)
+}
+
+// PutContext is Put which stops waiting for the write once ctx is done
+func (b *Bucket) PutContext(ctx context.Context, key, value string) error {
+	return b.write(ctx, &entry{key: b.key(key), value: value})
+}
+
+// PutWithTTL puts the value which is treated as deleted once ttl passes
+func (b *Bucket) PutWithTTL(key, value string, ttl time.Duration) error {
+	return b.PutWithTTLContext(context.Background(), key, value, ttl)
+}
+
+// PutWithTTLContext is PutWithTTL which stops waiting for the write once ctx is done
+func (b *Bucket) PutWithTTLContext(ctx context.Context, key, value string, ttl time.Duration) error {
+	if ttl <= 0 {
+		return fmt.Errorf("ttl must be positive, got %v", ttl)
+	}
+	return b.write(ctx, &entry{key: b.key(key), value: value, expiresAt: now().Add(ttl).UnixNano()})
+}
+
+// PutStream puts the value of the given size read from r without holding it in memory
+func (b *Bucket) PutStream(key string, r io.Reader, size int64) error {
+	return b.PutStreamContext(context.Background(), key, r, size)
+}
+
+// PutStreamContext is PutStream which stops reading the value and waiting for the write once ctx is done
+func (b *Bucket) PutStreamContext(ctx context.Context, key string, r io.Reader, size int64) error {
+	return b.db.putStream(ctx, b.key(key), r, size, b.name)
+}
+
+// CompareAndSwap puts the value only if the current version of the key is the expected one and returns the new version
+func (b *Bucket) CompareAndSwap(key string, expectedVersion uint64, value string) (uint64, error) {
+	return b.CompareAndSwapContext(context.Background(), key, expectedVersion, value)
+}
+
+// CompareAndSwapContext is CompareAndSwap which stops waiting for the write once ctx is done
+func (b *Bucket) CompareAndSwapContext(ctx context.Context, key string, expectedVersion uint64, value string) (uint64, error) {
+	return b.db.compareAndSwap(ctx, b.key(key), expectedVersion, value, b.name)
+}
+
+// Increment adds delta to the integer value of the key and returns the result, the missing key is taken as zero
+func (b *Bucket) Increment(key string, delta int64) (int64, error) {
+	return b.IncrementContext(context.Background(), key, delta)
+}
+
+// IncrementContext is Increment which stops waiting for the write once ctx is done
+func (b *Bucket) IncrementContext(ctx context.Context, key string, delta int64) (int64, error) {
+	return b.db.increment(ctx, b.key(key), delta, b.name)
+}
+
+// Append adds the suffix to the value of the key, the missing key is put with the suffix as the value
+func (b *Bucket) Append(key, suffix string) error {
+	return b.AppendContext(context.Background(), key, suffix)
+}
+
+// AppendContext is Append which stops waiting for the write once ctx is done
+func (b *Bucket) AppendContext(ctx context.Context, key, suffix string) error {
+	return b.db.append(ctx, b.key(key), suffix, b.name)
+}
+
+func (b *Bucket) Delete(key string) error {
+	return b.DeleteContext(context.Background(), key)
+}
+
+// DeleteContext is Delete which stops waiting for the write once ctx is done
+func (b *Bucket) DeleteContext(ctx context.Context, key string) error {
+	if b.db.readOnly {
+		return ErrReadOnly
+	}
+	exists, err := b.db.exists(b.key(key))
+	if err != nil || !exists {
+		return err
+	}
+	return b.write(ctx, &entry{key: b.key(key), deleted: true})
+}
+
+// Scan returns live keys of the bucket with the given prefix which are not less than start in sorted order
+func (b *Bucket) Scan(prefix, start string, limit int) ([]string, error) {
+	keys, err := b.db.scan(b.key(prefix), b.key(start), limit)
+	if err != nil {
+		return nil, err
+	}
+	for i, key := range keys {
+		keys[i] = strings.TrimPrefix(key, b.key(""))
+	}
+	return keys, nil
+}
@@ -0,0 +1,214 @@
+package datastore
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// encrypted value is stored in place of the plain one with the flag set in its size, the key and the metadata
+// of the record are authenticated along with it:
+// key id | nonce | sealed value
+const encryptedValueFlag = 1 << 31
+const keySize = 32
+const keyIdSize = 4
+
+// environment variables the keys are taken from when there are no key files
+const KeyEnv = "DB_ENCRYPTION_KEY"
+const OldKeysEnv = "DB_OLD_ENCRYPTION_KEYS"
+
+var ErrNoKey = fmt.Errorf("record is encrypted with a key which is not available")
+
+// Keyring holds the key new values are encrypted with and the older keys which are still needed to decrypt
+// the values written before rotation. Merge encrypts everything it rewrites with the current key, so the old
+// keys may be dropped after the first full merge
+type Keyring struct {
+	current uint32
+	keys    map[uint32]cipher.AEAD
+}
+
+// NewKeyring creates AES-256-GCM keyring, the keys are 32 bytes long
+func NewKeyring(current []byte, old ...[]byte) (*Keyring, error) {
+	k := &Keyring{keys: make(map[uint32]cipher.AEAD)}
+	for _, key := range append([][]byte{current}, old...) {
+		if len(key) != keySize {
+			return nil, fmt.Errorf("encryption key must be %d bytes long, got %d", keySize, len(key))
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		k.keys[keyId(key)] = aead
+	}
+	k.current = keyId(current)
+	return k, nil
+}
+
+// ParseKey decodes the hex encoded key
+func ParseKey(text string) ([]byte, error) {
+	key, err := hex.DecodeString(strings.TrimSpace(text))
+	if err != nil {
+		return nil, fmt.Errorf("encryption key must be hex encoded: %w", err)
+	}
+	return key, nil
+}
+
+// ReadKeyFile reads the hex encoded key from the file
+func ReadKeyFile(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseKey(string(data))
+}
+
+// LoadKeyring reads the current key from keyFile and the old ones from oldKeyFiles. When keyFile is empty,
+// the keys are taken from KeyEnv and the comma separated OldKeysEnv; nil is returned when there is no key at all
+func LoadKeyring(keyFile string, oldKeyFiles []string) (*Keyring, error) {
+	var (
+		current []byte
+		old     [][]byte
+		err     error
+	)
+	if keyFile != "" {
+		if current, err = ReadKeyFile(keyFile); err != nil {
+			return nil, err
+		}
+		for _, path := range oldKeyFiles {
+			key, err := ReadKeyFile(path)
+			if err != nil {
+				return nil, err
+			}
+			old = append(old, key)
+		}
+	} else {
+		text := os.Getenv(KeyEnv)
+		if text == "" {
+			return nil, nil
+		}
+		if current, err = ParseKey(text); err != nil {
+			return nil, err
+		}
+		for _, text := range strings.Split(os.Getenv(OldKeysEnv), ",") {
+			if strings.TrimSpace(text) == "" {
+				continue
+			}
+			key, err := ParseKey(text)
+			if err != nil {
+				return nil, err
+			}
+			old = append(old, key)
+		}
+	}
+	return NewKeyring(current, old...)
+}
+
+// keyId identifies the key in the records without revealing it
+func keyId(key []byte) uint32 {
+	sum := sha256.Sum256(key)
+	return binary.LittleEndian.Uint32(sum[:])
+}
+
+// additionalData binds the sealed value to the record, so it can't be moved to another key or version
+func additionalData(key string, expiresAt int64, version uint64) []byte {
+	res := make([]byte, len(key)+metaSize)
+	copy(res, key)
+	binary.LittleEndian.PutUint64(res[len(key):], uint64(expiresAt))
+	binary.LittleEndian.PutUint64(res[len(key)+8:], version)
+	return res
+}
+
+// seal returns the copy of the entry with the value encrypted by the current key, the entry itself is kept,
+// since its value is still used by the caller. Bucket registry records hold only the paths of the indexed fields,
+// they are kept plain, so the buckets of an encrypted database are opened without the key
+func (k *Keyring) seal(e *entry) (*entry, error) {
+	if e.deleted || e.encrypted || strings.HasPrefix(e.key, bucketRegistryPrefix) {
+		return e, nil
+	}
+	aead := k.keys[k.current]
+	sealed := make([]byte, keyIdSize+aead.NonceSize(), keyIdSize+aead.NonceSize()+len(e.value)+aead.Overhead())
+	binary.LittleEndian.PutUint32(sealed, k.current)
+	if _, err := rand.Read(sealed[keyIdSize:]); err != nil {
+		return nil, err
+	}
+	nonce := sealed[keyIdSize:]
+	sealed = aead.Seal(sealed, nonce, []byte(e.value), additionalData(e.key, e.expiresAt, e.version))
+
+	res := *e
+	res.value = string(sealed)
+	res.encrypted = true
+	return &res, nil
+}
+
+func (k *Keyring) open(key, value string, expiresAt int64, version uint64) (string, error) {
+	if len(value) < keyIdSize {
+		return "", ErrCorrupted
+	}
+	aead, ok := k.keys[binary.LittleEndian.Uint32([]byte(value))]
+	if !ok {
+		return "", ErrNoKey
+	}
+	if len(value) < keyIdSize+aead.NonceSize() {
+		return "", ErrCorrupted
+	}
+	nonce := []byte(value[keyIdSize : keyIdSize+aead.NonceSize()])
+	plain, err := aead.Open(nil, nonce, []byte(value[keyIdSize+aead.NonceSize():]), additionalData(key, expiresAt, version))
+	if err != nil {
+		return "", fmt.Errorf("cannot decrypt the value of %s: %w", key, ErrCorrupted)
+	}
+	return string(plain), nil
+}
+
+// decrypt replaces the encrypted value of the entry with the plain one
+func (k *Keyring) decrypt(e *entry) error {
+	if !e.encrypted {
+		return nil
+	}
+	if k == nil {
+		return ErrNoKey
+	}
+	value, err := k.open(e.key, e.value, e.expiresAt, e.version)
+	if err != nil {
+		return err
+	}
+	e.value = value
+	e.encrypted = false
+	return nil
+}
+
+// rotate makes sure the entry read by merge is encrypted with the current key. Without the keyring the values
+// are copied as they are, so the segments of an encrypted database may be merged without the key
+func (k *Keyring) rotate(e *entry) (*entry, error) {
+	if k == nil || e.deleted {
+		return e, nil
+	}
+	if e.encrypted && len(e.value) >= keyIdSize && binary.LittleEndian.Uint32([]byte(e.value)) == k.current {
+		return e, nil
+	}
+	if err := k.decrypt(e); err != nil {
+		return nil, err
+	}
+	return k.seal(e)
+}
+
+// Decrypt returns the plain value of the encrypted record read by ReadSegment
+func (k *Keyring) Decrypt(r Record) (string, error) {
+	if !r.Encrypted {
+		return r.Value, nil
+	}
+	if k == nil {
+		return "", ErrNoKey
+	}
+	return k.open(r.Key, r.Value, r.ExpiresAt, r.Version)
+}
@@ -1,41 +1,170 @@
 package datastore
 
 import (
+	"context"
 	"fmt"
-	"io"
 	"io/ioutil"
+	"log"
+	"math"
 	"os"
 	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
-
 const defMaxActiveSize = 10 * 1024 * 1024
+const defSyncInterval = time.Second
+const maxPutGroupSize = 128
+const defCloseTimeout = 30 * time.Second
 
 var ErrNotFound = fmt.Errorf("record does not exist")
 var ErrItemDeleted = fmt.Errorf("record has been deleted")
+var ErrCorrupted = fmt.Errorf("record is corrupted")
+var ErrVersionMismatch = fmt.Errorf("record version does not match the expected one")
+var ErrNotInteger = fmt.Errorf("record value is not an integer")
+var ErrOverflow = fmt.Errorf("integer overflow")
+var ErrReadOnly = fmt.Errorf("database is opened read-only")
+var ErrClosed = fmt.Errorf("database is closed")
+
+// now is replaced in tests to check expiration without waiting
+var now = time.Now
+
+// RecoveryPolicy defines how corrupted records found while opening the database are handled
+type RecoveryPolicy int
+
+const (
+	// RecoverFail refuses to open the database
+	RecoverFail RecoveryPolicy = iota
+	// RecoverTruncate cuts the torn tail of the active segment off, corruption in sealed segments still fails
+	RecoverTruncate
+	// RecoverSkip ignores corrupted records and reports them in Db.Corruptions
+	RecoverSkip
+)
+
+// Durability defines when written records are synced to the disk
+type Durability int
+
+const (
+	// SyncNever leaves syncing to the operating system, acknowledged writes may be lost on crash
+	SyncNever Durability = iota
+	// SyncInterval syncs the active segment every Options.SyncInterval, so only the writes of the last interval may be lost
+	SyncInterval
+	// SyncAlways makes writes visible and acknowledges them only after they are synced, concurrent writes share
+	// one sync
+	SyncAlways
+)
+
+type Options struct {
+	ActiveBlockSize  int64
+	AutoMergeEnabled bool
+	// MergePolicy decides when the automatic merge happens, the sealed segments are merged as soon as there are
+	// two of them when it's not set
+	MergePolicy  MergePolicy
+	Recovery     RecoveryPolicy
+	Durability   Durability
+	SyncInterval time.Duration
+	// IndexMode defines whether the indexes of sealed segments are kept in memory or on disk
+	IndexMode IndexMode
+	// BloomFilterRate is the false positive rate of the bloom filters of sealed segments, which let lookups
+	// skip the segments without the key; the filters are disabled when it's 0
+	BloomFilterRate float64
+	// Keyring encrypts the values written to the disk, they are stored as they are when it's not set. The values
+	// which are already on the disk are encrypted by the next merge
+	Keyring *Keyring
+	// ReplicationLogSize limits the size of the latest records kept in memory for followers
+	ReplicationLogSize int
+	// ReadOnly opens the database without writing anything to dir: writes fail with ErrReadOnly, nothing is merged,
+	// and the directory isn't locked, so it may be used by a writer meanwhile. The records its writer adds after
+	// the database is opened are not seen
+	ReadOnly bool
+}
+
+func DefaultOptions() Options {
+	return Options{
+		ActiveBlockSize:  defMaxActiveSize,
+		AutoMergeEnabled: true,
+		Recovery:         RecoverFail,
+		Durability:       SyncNever,
+		SyncInterval:     defSyncInterval,
+		BloomFilterRate:  defBloomFilterRate,
+
+		ReplicationLogSize: defReplicationLogSize,
+	}
+}
 
 type hashIndex map[string]int64
 
 type putEntry struct {
-	entry *entry
+	entries []*entry
+	// prepare is called from the put goroutine right before writing instead of using entries, so it sees
+	// the latest state of the database and nothing else can be written in between
+	prepare func() ([]*entry, error)
+	// replicated entries come from the leader with versions already set
+	replicated bool
+	// stream holds the value of the single entry put by PutStream
+	stream *spooledValue
+	// bucket the entries are put to, they are written only if it exists
+	bucket       string
 	responseChan chan error
 }
 
 type Db struct {
-	mux      *sync.RWMutex
-	out      *os.File
+	mux  *sync.RWMutex
+	out  *os.File
+	lock *dirLock
 
-	dir              string
-	activeBlockSize  int64
-	autoMergeEnabled bool
+	dir             string
+	activeBlockSize int64
+	// mergePolicy is nil when the automatic merge is disabled
+	mergePolicy MergePolicy
 
 	segments []*segment
-	mergeChan chan int
-	putChan   chan putEntry
+	// manual merge requests, the merge goroutine responds to them with the result
+	mergeChan  chan chan error
+	mergeCheck chan struct{}
+	mergeStop  chan struct{}
+	mergeDone  chan struct{}
+	// mergeAbort stops the running merge when the database can't wait for it to close
+	mergeAbort chan struct{}
+	abortOnce  sync.Once
+	putChan    chan putEntry
+	// putStop makes the put goroutine write the puts which are already waiting and exit
+	putStop   chan struct{}
+	putDone   chan struct{}
+	closeOnce sync.Once
+	// the last version given to a record, it's changed only by the put goroutine
+	version uint64
+	// the version of the last record added to the index, it's changed under the lock
+	indexedVersion uint64
+	changes        *changeLog
+
+	durability Durability
+	syncStop   chan struct{}
+	syncDone   chan struct{}
+	// closed is set under the lock once the segments are closed, the reads fail with ErrClosed after that
+	closed bool
+
+	bloomFilterRate float64
+	indexMode       IndexMode
+	keys            *Keyring
+	readOnly        bool
+	// secondary indexes of the buckets by their names, they are changed under the lock
+	secondary map[string][]*fieldIndex
+	// the running builds of the new secondary indexes, close waits for them
+	builds sync.WaitGroup
+
+	corruptions []Corruption
+
+	putLatency *latencyCounter
+	getLatency *latencyCounter
+	// merge statistics are changed under the lock together with the segments
+	merges             int
+	lastMerge          time.Time
+	lastMergeDuration  time.Duration
+	totalMergeDuration time.Duration
 }
 
 func NewDb(dir string) (*Db, error) {
@@ -51,199 +180,852 @@ func NewDbSized(dir string, activeBlockSize int64) (*Db, error) {
 }
 
 func NewDbSizedMerge(dir string, activeBlockSize int64, autoMergeEnabled bool) (*Db, error) {
-	outputPath := filepath.Join(dir, segmentPrefix + activeSuffix)
-	f, err := os.OpenFile(outputPath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o600)
+	opts := DefaultOptions()
+	opts.ActiveBlockSize = activeBlockSize
+	opts.AutoMergeEnabled = autoMergeEnabled
+	return NewDbWithOptions(dir, opts)
+}
+
+// NewDbWithOptions opens the database in dir, which stays locked until Close, so no other process may open it
+// unless it's opened read-only
+func NewDbWithOptions(dir string, opts Options) (*Db, error) {
+	if opts.ReadOnly {
+		return openDb(dir, opts)
+	}
+	lock, err := lockDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	db, err := openDb(dir, opts)
 	if err != nil {
+		lock.release()
 		return nil, err
 	}
+	db.lock = lock
+	return db, nil
+}
+
+func openDb(dir string, opts Options) (*Db, error) {
+	if opts.Durability == SyncInterval && opts.SyncInterval <= 0 {
+		opts.SyncInterval = defSyncInterval
+	}
+
+	// nothing is written to the read-only database, so the active segment is only read if it exists
+	var f *os.File
+	if !opts.ReadOnly {
+		var err error
+		outputPath := filepath.Join(dir, segmentPrefix+activeSuffix)
+		f, err = os.OpenFile(outputPath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o600)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	var segments []*segment
+	var corruptions []Corruption
 	files, err := ioutil.ReadDir(dir)
 	if err != nil {
+		f.Close()
 		return nil, err
 	}
 
 	for _, fileInfo := range files {
-		if strings.HasPrefix(fileInfo.Name(), segmentPrefix) {
-			s := &segment{
-				path:  filepath.Join(dir, fileInfo.Name()),
-				index: make(hashIndex),
+		// values spooled by PutStream are written again by their writers, if at all
+		if strings.HasSuffix(fileInfo.Name(), streamSuffix) && !opts.ReadOnly {
+			os.Remove(filepath.Join(dir, fileInfo.Name()))
+		}
+		if !isSegmentFile(fileInfo.Name()) {
+			continue
+		}
+		s := newSegment(filepath.Join(dir, fileInfo.Name()))
+
+		// sealed segments never change, so their index may be taken from the hint file written on sealing;
+		// a damaged header is left for recover to report
+		if !s.isActive() && s.loadFormat() == nil {
+			var err error
+			if opts.IndexMode == IndexOnDisk {
+				err = s.loadDiskIndex()
+			} else {
+				err = s.loadHint()
 			}
-
-			err := s.recover()
-			if err != io.EOF {
-				return nil, err
+			if err == nil {
+				segments = append(segments, s)
+				continue
+			}
+			if !os.IsNotExist(err) {
+				log.Printf("cannot use hint file of %s, reading the whole segment: %v", s.path, err)
 			}
+		}
 
-			segments = append(segments, s)
+		c, err := s.recover(opts.Recovery, opts.ReadOnly)
+		if err != nil {
+			f.Close()
+			s.close()
+			for _, s := range segments {
+				s.close()
+			}
+			return nil, err
 		}
-	}
+		for _, corruption := range c {
+			log.Printf("skipped corrupted data in %v", corruption)
+		}
+		corruptions = append(corruptions, c...)
 
-	// sort segments
-	sort.Slice(segments, func(i, j int) bool {
-		stringSuffixI := segments[i].path[len(dir + segmentPrefix) + 1:]
-		stringSuffixJ := segments[j].path[len(dir + segmentPrefix) + 1:]
-		if stringSuffixI == activeSuffix || stringSuffixJ == mergedSuffix {
-			return true
+		// the index of a segment with skipped corruptions is kept in memory, so the segment is read again next time
+		if !s.isActive() && len(c) == 0 && !opts.ReadOnly {
+			if err := s.saveIndex(opts.IndexMode); err != nil {
+				log.Printf("cannot write hint file of %s: %v", s.path, err)
+			}
 		}
-		if stringSuffixJ == activeSuffix || stringSuffixI == mergedSuffix {
-			return false
+		if s.isActive() && s.offset == 0 && !opts.ReadOnly {
+			if err := s.writeHeader(f); err != nil {
+				f.Close()
+				return nil, err
+			}
 		}
 
-		suffixI, errI := strconv.Atoi(stringSuffixI)
-		suffixJ, errJ := strconv.Atoi(stringSuffixJ)
+		segments = append(segments, s)
+	}
+
+	if opts.BloomFilterRate > 0 {
+		for _, s := range segments {
+			if !s.isActive() {
+				s.initFilter(opts.BloomFilterRate, !opts.ReadOnly)
+			}
+		}
+	}
 
-		return errJ != nil || (errI != nil && suffixI > suffixJ)
+	// newer segments go first, so the lookup finds the latest value of a key
+	sort.Slice(segments, func(i, j int) bool {
+		return segmentOrder(segments[i].path) > segmentOrder(segments[j].path)
 	})
 
-	mergeChan := make(chan int)
+	var version uint64
+	for _, s := range segments {
+		if s.maxVersion > version {
+			version = s.maxVersion
+		}
+	}
+
 	putChan := make(chan putEntry)
 
+	mergePolicy := opts.MergePolicy
+	if mergePolicy == nil {
+		mergePolicy = defaultMergePolicy()
+	}
+	if !opts.AutoMergeEnabled {
+		mergePolicy = nil
+	}
+
 	db := &Db{
-		mux:              new(sync.RWMutex),
-		out:              f,
-		dir:              dir,
-		activeBlockSize:  activeBlockSize,
-		autoMergeEnabled: autoMergeEnabled,
-		segments:         segments,
-		mergeChan:        mergeChan,
-		putChan:          putChan,
-	}
-
-	go func() {
-		for el := range mergeChan {
-			if el == 0 {
-				return
-			}
+		mux:             new(sync.RWMutex),
+		out:             f,
+		dir:             dir,
+		activeBlockSize: opts.ActiveBlockSize,
+		mergePolicy:     mergePolicy,
+		segments:        segments,
+		mergeChan:       make(chan chan error),
+		mergeCheck:      make(chan struct{}, 1),
+		mergeStop:       make(chan struct{}),
+		mergeAbort:      make(chan struct{}),
+		mergeDone:       make(chan struct{}),
+		putChan:         putChan,
+		putStop:         make(chan struct{}),
+		putDone:         make(chan struct{}),
+		version:         version,
+		indexedVersion:  version,
+		changes:         newChangeLog(version, opts.ReplicationLogSize),
+		durability:      opts.Durability,
+		syncStop:        make(chan struct{}),
+		syncDone:        make(chan struct{}),
+		bloomFilterRate: opts.BloomFilterRate,
+		indexMode:       opts.IndexMode,
+		keys:            opts.Keyring,
+		readOnly:        opts.ReadOnly,
+		secondary:       make(map[string][]*fieldIndex),
+		corruptions:     corruptions,
+		putLatency:      new(latencyCounter),
+		getLatency:      new(latencyCounter),
+	}
 
-			db.merge()
+	// records of the current format can't follow the baseline ones, so the baseline active segment is sealed as is
+	if !opts.ReadOnly && segments[0].version == baselineFormat {
+		if _, err := db.addSegment(); err != nil {
+			db.out.Close()
+			for _, s := range segments {
+				s.close()
+			}
+			return nil, fmt.Errorf("cannot seal baseline active segment: %w", err)
 		}
-	}()
+	}
 
-	go func() {
-		for el := range putChan {
-			db.put(el)
+	// secondary indexes are not stored, so they are built from the values every time
+	if err := db.loadSecondary(); err != nil {
+		db.out.Close()
+		for _, s := range db.segments {
+			s.close()
 		}
-	}()
+		return nil, fmt.Errorf("cannot build secondary indexes: %w", err)
+	}
+
+	// a writer may merge the segments of the read-only database away, but their files have been opened to build
+	// the indexes, and they are kept until Close
+	if opts.ReadOnly {
+		return db, nil
+	}
+
+	go db.mergeLoop()
+	go db.putLoop()
+	if opts.Durability == SyncInterval {
+		go db.syncLoop(opts.SyncInterval)
+	} else {
+		close(db.syncDone)
+	}
 
 	return db, nil
 }
 
+// Close closes the database waiting at most defCloseTimeout for the puts in flight and the running merge
 func (db *Db) Close() error {
-	db.mergeChan <- 0
-	close(db.putChan)
-	return db.out.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), defCloseTimeout)
+	defer cancel()
+	return db.CloseContext(ctx)
+}
+
+// CloseContext writes the puts which are already sent to the put goroutine and waits for the running merge, the later
+// writes and merges fail with ErrClosed. If they don't finish before ctx is done, the merge is aborted, ctx error
+// is returned and the database stays open, so Close may be called again
+func (db *Db) CloseContext(ctx context.Context) error {
+	if !db.readOnly {
+		db.closeOnce.Do(func() {
+			close(db.putStop)
+			close(db.mergeStop)
+			if db.durability == SyncInterval {
+				close(db.syncStop)
+			}
+		})
+		// the builds are started by the puts, so they are waited for once the put goroutine is done
+		for _, done := range []chan struct{}{db.putDone, db.mergeDone, db.syncDone, db.buildsDone()} {
+			select {
+			case <-done:
+			case <-ctx.Done():
+				db.abortOnce.Do(func() { close(db.mergeAbort) })
+				return fmt.Errorf("cannot close database: %w", ctx.Err())
+			}
+		}
+	}
+	db.mux.Lock()
+	if db.closed {
+		db.mux.Unlock()
+		return nil
+	}
+	db.closed = true
+	for _, s := range db.segments {
+		s.close()
+	}
+	db.mux.Unlock()
+	if db.readOnly {
+		return nil
+	}
+
+	var err error
+	if db.durability != SyncNever {
+		err = db.out.Sync()
+	}
+	if closeErr := db.out.Close(); err == nil {
+		err = closeErr
+	}
+	if releaseErr := db.lock.release(); err == nil {
+		err = releaseErr
+	}
+	return err
 }
 
 func (db *Db) Get(key string) (string, error) {
+	value, _, err := db.GetWithVersion(key)
+	return value, err
+}
+
+// GetContext is Get which fails with the ctx error once ctx is done. The read itself isn't interrupted
+func (db *Db) GetContext(ctx context.Context, key string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	return db.Get(key)
+}
+
+// GetWithVersion returns the value with the version of the write which has put it
+func (db *Db) GetWithVersion(key string) (string, uint64, error) {
+	e, err := db.getEntry(key)
+	if err != nil {
+		return "", 0, err
+	}
+	return e.value, e.version, nil
+}
+
+// GetWithVersionContext is GetWithVersion which fails with the ctx error once ctx is done
+func (db *Db) GetWithVersionContext(ctx context.Context, key string) (string, uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return "", 0, err
+	}
+	return db.GetWithVersion(key)
+}
+
+func (db *Db) getEntry(key string) (*entry, error) {
+	defer db.getLatency.observe(time.Now())
 	db.mux.RLock()
 	defer db.mux.RUnlock()
+	if db.closed {
+		return nil, ErrClosed
+	}
 
 	var (
-		value	 string
-		err      error
+		e   *entry
+		err error
 	)
 
 	for _, segment := range db.segments {
-		value, err = segment.get(key)
+		e, err = segment.getEntry(key)
+		if err == ErrNotFound {
+			continue
+		}
 		if err == ErrItemDeleted {
-			return "", ErrNotFound
+			return nil, ErrNotFound
 		}
 		if err == nil {
-			return value, nil
+			err = db.keys.decrypt(e)
 		}
+		// older segments can't be used as a fallback, they may contain an outdated value
+		return e, err
+	}
+
+	return nil, ErrNotFound
+}
+
+// Corruptions returns damaged parts of segment files which were skipped or truncated while opening the database
+func (db *Db) Corruptions() []Corruption {
+	return db.corruptions
+}
+
+// Scan returns live keys with the given prefix which are not less than start in sorted order.
+// At most limit keys are returned, non-positive limit means no limit. The keys of buckets are not returned
+func (db *Db) Scan(prefix, start string, limit int) ([]string, error) {
+	if start < userKeysStart {
+		start = userKeysStart
+	}
+	return db.scan(prefix, start, limit)
+}
+
+func (db *Db) scan(prefix, start string, limit int) ([]string, error) {
+	if start < prefix {
+		start = prefix
 	}
+	end := prefixEnd(prefix)
+
+	// the in-memory indexes are copied limit keys at a time, so paging doesn't copy the keys of the other pages
+	var keys []string
+	t := now().UnixNano()
+	for {
+		db.mux.RLock()
+		if db.closed {
+			db.mux.RUnlock()
+			return nil, ErrClosed
+		}
+		segments := make([]*segment, len(db.segments))
+		copy(segments, db.segments)
+		cursors, bound, err := openRangeCursors(segments, start, end, limit)
+		db.mux.RUnlock()
+		if err != nil {
+			return nil, err
+		}
 
-	return "", err
+		// the newest index a key is found in decides whether it is alive
+		err = mergeKeys(segments, cursors, func(s *segment, e indexEntry) (bool, error) {
+			if e.key < start {
+				return true, nil
+			}
+			if end != "" && e.key >= end || bound != "" && e.key > bound {
+				return false, nil
+			}
+			if e.alive(t) {
+				keys = append(keys, e.key)
+			}
+			return limit <= 0 || len(keys) < limit, nil
+		})
+		closeCursors(cursors)
+		if err != nil || bound == "" || len(keys) >= limit {
+			return keys, err
+		}
+		start = bound + "\x00"
+	}
 }
 
 func (db *Db) Put(key, value string) error {
-	responseChan := make(chan error)
-	e := &entry{ key: key, value: value }
+	return db.PutContext(context.Background(), key, value)
+}
 
-	db.putChan <- putEntry{ entry: e, responseChan: responseChan }
-	res := <- responseChan
-	return res
+// PutContext is Put which stops waiting for the write once ctx is done. The value may be written anyway
+// if the put goroutine has already taken it
+func (db *Db) PutContext(ctx context.Context, key, value string) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	return db.sendContext(ctx, putEntry{entries: []*entry{{key: key, value: value}}})
+}
+
+// PutWithTTL puts the value which is treated as deleted once ttl passes, merge drops it from the disk afterwards
+func (db *Db) PutWithTTL(key, value string, ttl time.Duration) error {
+	return db.PutWithTTLContext(context.Background(), key, value, ttl)
 }
 
-func (db *Db) put(pe putEntry) {
-	if len(db.segments) > 2 && db.autoMergeEnabled {
-		go func() {
-			db.mergeChan <- 1
-		}()
+// PutWithTTLContext is PutWithTTL which stops waiting for the write once ctx is done
+func (db *Db) PutWithTTLContext(ctx context.Context, key, value string, ttl time.Duration) error {
+	if ttl <= 0 {
+		return fmt.Errorf("ttl must be positive, got %v", ttl)
 	}
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	return db.write(ctx, []*entry{{key: key, value: value, expiresAt: now().Add(ttl).UnixNano()}})
+}
 
-	e := pe.entry
-	n, err := db.out.Write(e.Encode())
-	if err != nil {
-		pe.responseChan <- err
-		return
+// Write applies all the operations of the batch atomically
+func (db *Db) Write(b *WriteBatch) error {
+	return db.WriteContext(context.Background(), b)
+}
+
+// WriteContext is Write which stops waiting for the batch once ctx is done, the batch is either written
+// as a whole or not at all anyway
+func (db *Db) WriteContext(ctx context.Context, b *WriteBatch) error {
+	if b.Len() == 0 {
+		return nil
+	}
+	for _, e := range b.entries {
+		if err := checkKey(e.key); err != nil {
+			return err
+		}
 	}
+	return db.write(ctx, b.entries)
+}
 
-	// we need this lock to be sure that we won't have concurrent read/write from get/put in our map(index)
-	// we could create mutex in every segment and lock it, but have a mutex instance in every segment
-	// is overkill in our opinion, so we decided to lock entire database
-	db.mux.Lock()
-	activeSegment := db.segments[0]
-	if e.value != "" {
-		activeSegment.index[e.key] = activeSegment.offset
-	} else {
-		activeSegment.index[e.key] = deletedItemPos
+// CompareAndSwap puts the value only if the current version of the key is the expected one and returns the new version.
+// Zero version means that the key must not exist
+func (db *Db) CompareAndSwap(key string, expectedVersion uint64, value string) (uint64, error) {
+	return db.CompareAndSwapContext(context.Background(), key, expectedVersion, value)
+}
+
+// CompareAndSwapContext is CompareAndSwap which stops waiting for the write once ctx is done
+func (db *Db) CompareAndSwapContext(ctx context.Context, key string, expectedVersion uint64, value string) (uint64, error) {
+	if err := checkKey(key); err != nil {
+		return 0, err
 	}
-	activeSegment.offset += int64(n)
-	db.mux.Unlock()
+	return db.compareAndSwap(ctx, key, expectedVersion, value, "")
+}
+
+func (db *Db) compareAndSwap(ctx context.Context, key string, expectedVersion uint64, value, bucket string) (uint64, error) {
+	e := &entry{key: key, value: value}
+	err := db.sendContext(ctx, putEntry{bucket: bucket, prepare: func() ([]*entry, error) {
+		current, err := db.getEntry(key)
+		if err != nil && err != ErrNotFound {
+			return nil, err
+		}
 
-	fi, err := os.Stat(activeSegment.path)
+		// only the missing key matches zero version, whatever version the existing one has
+		if err == ErrNotFound && expectedVersion != 0 || err == nil && current.version != expectedVersion {
+			return nil, ErrVersionMismatch
+		}
+		return []*entry{e}, nil
+	}})
 	if err != nil {
-		fmt.Errorf("can not read active file stat: %v", err)
-		// return nil because we have already put value to db and user shouldn't know about segmentation error
-		pe.responseChan <- nil
-		return
+		return 0, err
 	}
+	return e.version, nil
+}
 
-	if fi.Size() >= db.activeBlockSize {
-		_, err = db.addSegment()
-		if err != nil {
-			// return nil because we have already put value to db and user shouldn't know about segmentation error
-			pe.responseChan <- nil
-			return
+// Increment adds delta to the integer value of the key and returns the result, the missing key is taken as zero.
+// The value keeps its expiration time
+func (db *Db) Increment(key string, delta int64) (int64, error) {
+	return db.IncrementContext(context.Background(), key, delta)
+}
+
+// IncrementContext is Increment which stops waiting for the write once ctx is done
+func (db *Db) IncrementContext(ctx context.Context, key string, delta int64) (int64, error) {
+	if err := checkKey(key); err != nil {
+		return 0, err
+	}
+	return db.increment(ctx, key, delta, "")
+}
+
+func (db *Db) increment(ctx context.Context, key string, delta int64, bucket string) (int64, error) {
+	var result int64
+	err := db.update(ctx, key, bucket, func(value string, exists bool) (string, error) {
+		if exists {
+			var err error
+			if result, err = strconv.ParseInt(value, 10, 64); err != nil {
+				return "", ErrNotInteger
+			}
+		}
+		if delta > 0 && result > math.MaxInt64-delta || delta < 0 && result < math.MinInt64-delta {
+			return "", ErrOverflow
 		}
+		result += delta
+		return strconv.FormatInt(result, 10), nil
+	})
+	if err != nil {
+		// the put goroutine may still be changing the result of the abandoned request
+		return 0, err
 	}
+	return result, nil
+}
 
-	pe.responseChan <- nil
+// Append adds the suffix to the value of the key, the missing key is put with the suffix as the value.
+// The value keeps its expiration time
+func (db *Db) Append(key, suffix string) error {
+	return db.AppendContext(context.Background(), key, suffix)
 }
 
-func (db *Db) Delete(key string) error {
-	db.mux.Lock()
-	defer db.mux.Unlock()
+// AppendContext is Append which stops waiting for the write once ctx is done
+func (db *Db) AppendContext(ctx context.Context, key, suffix string) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	return db.append(ctx, key, suffix, "")
+}
 
-	for _, segment := range db.segments {
-		pos, ok := segment.index[key]
-		if pos == deletedItemPos {
-			break
+func (db *Db) append(ctx context.Context, key, suffix, bucket string) error {
+	return db.update(ctx, key, bucket, func(value string, exists bool) (string, error) {
+		return value + suffix, nil
+	})
+}
+
+// update replaces the value of the key with the one returned by change. The current value is read by the put
+// goroutine, so nothing can be written to the key in between
+func (db *Db) update(ctx context.Context, key, bucket string, change func(value string, exists bool) (string, error)) error {
+	return db.sendContext(ctx, putEntry{bucket: bucket, prepare: func() ([]*entry, error) {
+		e := &entry{key: key}
+		current, err := db.getEntry(key)
+		if err == nil {
+			e.value, e.expiresAt = current.value, current.expiresAt
+		} else if err != ErrNotFound {
+			return nil, err
 		}
 
-		if ok {
-			e := &entry{key: key}
-			n, err := db.out.Write(e.EncodeDeleted())
-			if err != nil {
-				return err
+		if e.value, err = change(e.value, err == nil); err != nil {
+			return nil, err
+		}
+		return []*entry{e}, nil
+	}})
+}
+
+func (db *Db) write(ctx context.Context, entries []*entry) error {
+	return db.sendContext(ctx, putEntry{entries: entries})
+}
+
+func (db *Db) send(pe putEntry) error {
+	return db.sendContext(context.Background(), pe)
+}
+
+func (db *Db) sendContext(ctx context.Context, pe putEntry) error {
+	start := time.Now()
+	responseChan, err := db.handOff(ctx, pe)
+	if err != nil {
+		return err
+	}
+	defer db.putLatency.observe(start)
+	select {
+	case err := <-responseChan:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// handOff passes the request to the put goroutine and returns the channel of its result. The put goroutine
+// always answers the request it has taken, but doesn't wait for the callers which have given up
+func (db *Db) handOff(ctx context.Context, pe putEntry) (chan error, error) {
+	if db.readOnly {
+		return nil, ErrReadOnly
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	responseChan := make(chan error, 1)
+	pe.responseChan = responseChan
+
+	select {
+	case db.putChan <- pe:
+		return responseChan, nil
+	case <-db.putStop:
+		return nil, ErrClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// putLoop serves write requests in groups: requests which came while the previous group was being written share
+// a single write and sync, so strict durability doesn't cost a sync for every put
+func (db *Db) putLoop() {
+	defer close(db.putDone)
+	for {
+		var group []putEntry
+		select {
+		case pe := <-db.putChan:
+			group = append(group, pe)
+		case <-db.putStop:
+			// the senders which are blocked already are served, the ones which come later see putStop
+		}
+	collect:
+		for len(group) < maxPutGroupSize {
+			select {
+			case pe := <-db.putChan:
+				group = append(group, pe)
+			default:
+				break collect
 			}
+		}
+		if len(group) == 0 {
+			return
+		}
+		db.put(group)
+	}
+}
+
+func (db *Db) put(group []putEntry) {
+	results := make([]error, len(group))
 
+	var (
+		buf       []byte
+		pending   []int
+		starts    []int
+		positions [][]int64
+	)
+	flush := func() {
+		if len(buf) == 0 {
+			return
+		}
+		db.mux.RLock()
+		offset := db.segments[0].offset
+		db.mux.RUnlock()
+		n, err := db.out.Write(buf)
+		if err == nil && db.durability == SyncAlways {
+			// the records are indexed and sent to the followers only once they are synced
+			err = db.out.Sync()
+		}
+		if err != nil {
+			// the records written later must not follow the torn or unsynced ones
+			if truncateErr := db.out.Truncate(offset); truncateErr != nil {
+				log.Printf("cannot remove torn records: %v", truncateErr)
+			}
+			for _, i := range pending {
+				results[i] = err
+			}
+		} else {
+			// we need this lock to be sure that we won't have concurrent read/write from get/put in our map(index)
+			// we could create mutex in every segment and lock it, but have a mutex instance in every segment
+			// is overkill in our opinion, so we decided to lock entire database
+			db.mux.Lock()
 			activeSegment := db.segments[0]
-			activeSegment.index[key] = deletedItemPos
+			for j, i := range pending {
+				for k, e := range group[i].entries {
+					activeSegment.addToIndex(e, activeSegment.offset+positions[j][k])
+					db.updateSecondary(e)
+				}
+			}
 			activeSegment.offset += int64(n)
-			break
+			if last := lastVersion(group[pending[len(pending)-1]].entries); last > db.indexedVersion {
+				db.indexedVersion = last
+			}
+			db.mux.Unlock()
+
+			for j, i := range pending {
+				end := len(buf)
+				if j+1 < len(starts) {
+					end = starts[j+1]
+				}
+				db.changes.append(buf[starts[j]:end], lastVersion(group[i].entries))
+			}
 		}
+		buf, pending, starts, positions = nil, nil, nil, nil
 	}
 
-	return nil
+	for i := range group {
+		pe := &group[i]
+		if pe.bucket != "" {
+			// the bucket may be created or dropped by the previous entries, so they are written first
+			flush()
+			if err := db.checkBucket(pe.bucket); err != nil {
+				results[i] = err
+				continue
+			}
+		}
+		if pe.prepare != nil {
+			// prepare reads the database, so everything before it has to be written and indexed
+			flush()
+			entries, err := pe.prepare()
+			if err != nil {
+				results[i] = err
+				continue
+			}
+			pe.entries = entries
+		}
+		if len(pe.entries) == 0 {
+			continue
+		}
+		for _, e := range pe.entries {
+			if !pe.replicated {
+				db.version++
+				e.version = db.version
+			} else if e.version > db.version {
+				db.version = e.version
+			}
+		}
+
+		if pe.stream != nil {
+			// the value is copied right from the spooled file, so the records before it are written first
+			flush()
+			results[i] = db.writeStream(pe.entries[0], pe.stream)
+			continue
+		}
+
+		// replicated values are written as the leader has written them
+		records := pe.entries
+		if db.keys != nil && !pe.replicated {
+			var err error
+			if records, err = db.seal(pe.entries); err != nil {
+				results[i] = err
+				continue
+			}
+		}
+
+		var (
+			data []byte
+			pos  []int64
+		)
+		if len(records) == 1 {
+			data, pos = records[0].encode(), []int64{0}
+		} else {
+			data, pos = encodeBatch(records)
+		}
+		for k := range pos {
+			pos[k] += int64(len(buf))
+		}
+		starts = append(starts, len(buf))
+		buf = append(buf, data...)
+		pending = append(pending, i)
+		positions = append(positions, pos)
+	}
+	flush()
+
+	// the header doesn't count, so the block size is the size of the records
+	db.mux.RLock()
+	activeSize := db.segments[0].offset - db.segments[0].headerSize()
+	db.mux.RUnlock()
+	if activeSize >= db.activeBlockSize {
+		// the error isn't returned because we have already put values to db and user shouldn't know about
+		// segmentation error
+		if _, err := db.addSegment(); err != nil {
+			log.Printf("cannot add segment: %v", err)
+		} else {
+			db.checkMerge()
+		}
+	}
+
+	for i, pe := range group {
+		pe.responseChan <- results[i]
+	}
+}
+
+// seal returns the entries to write with their values encrypted
+func (db *Db) seal(entries []*entry) ([]*entry, error) {
+	res := make([]*entry, len(entries))
+	for i, e := range entries {
+		sealed, err := db.keys.seal(e)
+		if err != nil {
+			return nil, err
+		}
+		res[i] = sealed
+	}
+	return res, nil
+}
+
+func lastVersion(entries []*entry) uint64 {
+	var version uint64
+	for _, e := range entries {
+		if e.version > version {
+			version = e.version
+		}
+	}
+	return version
+}
+
+// syncLoop syncs the active segment periodically for SyncInterval durability
+func (db *Db) syncLoop(interval time.Duration) {
+	defer close(db.syncDone)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			// read lock keeps addSegment from closing the file while it's being synced
+			db.mux.RLock()
+			err := db.out.Sync()
+			db.mux.RUnlock()
+			if err != nil {
+				log.Printf("cannot sync active segment: %v", err)
+			}
+		case <-db.syncStop:
+			return
+		}
+	}
+}
+
+func (db *Db) Delete(key string) error {
+	return db.DeleteContext(context.Background(), key)
+}
+
+// DeleteContext is Delete which stops waiting for the write once ctx is done
+func (db *Db) DeleteContext(ctx context.Context, key string) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	// tombstone is written only for existing keys, the write itself goes through the put goroutine like any other
+	exists, err := db.exists(key)
+	if err != nil || !exists {
+		return err
+	}
+	return db.sendContext(ctx, putEntry{entries: []*entry{{key: key, deleted: true}}})
+}
+
+func (db *Db) exists(key string) (bool, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+	if db.closed {
+		return false, ErrClosed
+	}
+	for _, segment := range db.segments {
+		e, ok, err := segment.lookup(key)
+		if err != nil {
+			return false, err
+		}
+		if ok {
+			return e.alive(now().UnixNano()), nil
+		}
+	}
+	return false, nil
 }
 
 func (db *Db) addSegment() (*segment, error) {
 	db.mux.Lock()
 	defer db.mux.Unlock()
 
+	if db.durability != SyncNever {
+		if err := db.out.Sync(); err != nil {
+			return nil, err
+		}
+	}
 	err := db.out.Close()
 	if err != nil {
 		return nil, err
@@ -251,20 +1033,33 @@ func (db *Db) addSegment() (*segment, error) {
 
 	segmentSuffix := 0
 	if len(db.segments) > 1 {
-		lastSavedSegmentSuffix := db.segments[1].path[len(db.dir + segmentPrefix) + 1:]
+		lastSavedSegmentSuffix := db.segments[1].path[len(db.dir+segmentPrefix)+1:]
 		if prevSegmentSuffix, err := strconv.Atoi(lastSavedSegmentSuffix); err == nil {
 			segmentSuffix = prevSegmentSuffix + 1
 		}
 	}
 
 	segmentPath := filepath.Join(db.dir, fmt.Sprintf("%v%v", segmentPrefix, segmentSuffix))
-	outputPath := filepath.Join(db.dir, segmentPrefix + activeSuffix)
+	outputPath := filepath.Join(db.dir, segmentPrefix+activeSuffix)
 
 	err = os.Rename(outputPath, segmentPath)
 	if err != nil {
 		return nil, err
 	}
 	db.segments[0].path = segmentPath
+	// the segment keeps its in-memory index if the hint can't be written
+	if err := db.segments[0].saveIndex(db.indexMode); err != nil {
+		log.Printf("cannot write hint file of %s: %v", segmentPath, err)
+	}
+	if db.bloomFilterRate > 0 {
+		err := db.segments[0].buildFilter(db.bloomFilterRate)
+		if err == nil {
+			err = db.segments[0].writeFilter()
+		}
+		if err != nil {
+			log.Printf("cannot write bloom filter file of %s: %v", segmentPath, err)
+		}
+	}
 
 	f, err := os.OpenFile(outputPath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o600)
 	if err != nil {
@@ -272,63 +1067,183 @@ func (db *Db) addSegment() (*segment, error) {
 	}
 	db.out = f
 
-	s := &segment{
-		path:  outputPath,
-		index: make(hashIndex),
+	s := newSegment(outputPath)
+	if err := s.writeHeader(f); err != nil {
+		return nil, err
 	}
 	db.segments = append([]*segment{s}, db.segments...)
 
 	return s, nil
 }
 
-func (db *Db) merge() {
-	segmentsToMerge := db.segments[1:]
-	segments := make([]*segment, len(segmentsToMerge))
-	copy(segments, segmentsToMerge)
+// Merge merges all the sealed segments right away, regardless of the merge policy
+func (db *Db) Merge() error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	done := make(chan error)
+	select {
+	case db.mergeChan <- done:
+		return <-done
+	case <-db.mergeStop:
+		return ErrClosed
+	}
+}
 
-	if len(segments) < 2 {
+// checkMerge asks the merge goroutine to consult the merge policy, it doesn't wait if the goroutine is busy
+func (db *Db) checkMerge() {
+	if db.mergePolicy == nil {
 		return
 	}
+	select {
+	case db.mergeCheck <- struct{}{}:
+	default:
+	}
+}
+
+func (db *Db) mergeLoop() {
+	defer close(db.mergeDone)
+	ticker := time.NewTicker(mergeCheckInterval)
+	defer ticker.Stop()
 
-	keysSegments := make(map[string]*segment)
+	for {
+		select {
+		case <-db.mergeStop:
+			return
+		case done := <-db.mergeChan:
+			done <- db.merge()
+			continue
+		case <-db.mergeCheck:
+		case <-ticker.C:
+		}
 
-	for i := len(segments) - 1; i >= 0; i-- {
-		s := segments[i]
-		for k, p := range segments[i].index {
-			if p != deletedItemPos {
-				keysSegments[k] = s
+		if db.mergePolicy != nil && db.mergePolicy.ShouldMerge(db.mergeState(needsGarbageRatio(db.mergePolicy))) {
+			if err := db.merge(); err != nil && err != ErrClosed {
+				log.Printf("error occured in merge: %v", err)
 			}
 		}
 	}
+}
+
+func (db *Db) merge() error {
+	db.mux.RLock()
+	segmentsToMerge := db.segments[1:]
+	segments := make([]*segment, len(segmentsToMerge))
+	copy(segments, segmentsToMerge)
+	cursors, err := openCursors(segments)
+	db.mux.RUnlock()
+	if err != nil {
+		return err
+	}
+	defer closeCursors(cursors)
+
+	if len(segments) == 0 {
+		return nil
+	}
+	start := time.Now()
 
 	segmentPath := filepath.Join(db.dir, segmentPrefix)
-	f, err := os.OpenFile(segmentPath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o600)
+	// the file may be left by a merge interrupted by a crash
+	f, err := os.OpenFile(segmentPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
 	if err != nil {
-		fmt.Errorf("error occured in merge: %v", err)
-		return
+		return err
 	}
 	defer f.Close()
 
-	segment := &segment{
-		path: segmentPath,
-		index: make(hashIndex),
+	merged := newSegment(segmentPath)
+	if err := merged.writeHeader(f); err != nil {
+		return err
+	}
+	// versions of the dropped records are kept, so they won't be given again after restart
+	var maxVersion uint64
+	for _, s := range segments {
+		if s.maxVersion > maxVersion {
+			maxVersion = s.maxVersion
+		}
+	}
+	if err := merged.writeMarker(f, maxVersion); err != nil {
+		return err
+	}
+	// keys come sorted, so the hint is written along with the segment
+	hint, err := newHintWriter(merged.hintPath())
+	if err != nil {
+		return err
 	}
 
-	for k, s := range keysSegments {
-		value, err := s.get(k)
-		if value != "" && err == nil {
-			e := (&entry{
-				key:   k,
-				value: value,
-			}).Encode()
+	onDisk := db.indexMode == IndexOnDisk
+	t := now().UnixNano()
+	err = mergeKeys(segments, cursors, func(s *segment, ie indexEntry) (bool, error) {
+		select {
+		case <-db.mergeAbort:
+			// the database is being closed, the unfinished file is overwritten by the next merge
+			return false, ErrClosed
+		default:
+		}
+		if !ie.alive(t) {
+			// the oldest segment is always merged, so there is nothing left for the tombstone or expired value
+			// to hide and it can be dropped
+			return true, nil
+		}
+		in, err := s.readFile()
+		if err != nil {
+			return false, err
+		}
+		e, err := readEntryAt(in, ie.position, s.version)
+		if err != nil {
+			// the old segments are kept, skipping the record would lose it
+			return false, fmt.Errorf("cannot read %s from %s: %w", ie.key, s.path, err)
+		}
+		// values are encrypted with the current key as they are rewritten, so merge completes the key rotation
+		if e, err = db.keys.rotate(e); err != nil {
+			return false, fmt.Errorf("cannot encrypt %s from %s: %w", ie.key, s.path, err)
+		}
 
-			n, err := f.Write(e)
-			if err != nil {
-				fmt.Errorf("error occured in merge: %v", err)
-				return
-			}
-			segment.index[k] = segment.offset
-			segment.offset += int64(n)
+		n, err := f.Write(e.Encode())
+		if err != nil {
+			return false, err
+		}
+		if err := hint.add(indexEntry{key: e.key, position: merged.offset, expiresAt: e.expiresAt}); err != nil {
+			return false, err
+		}
+		if onDisk {
+			merged.records++
+		} else {
+			merged.addToIndex(e, merged.offset)
+		}
+		merged.offset += int64(n)
+		return true, nil
+	})
+	if err != nil {
+		hint.abort()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		hint.abort()
+		return err
+	}
+	hintErr := hint.finish(segmentPath, merged.maxVersion, merged.records)
+	if hintErr != nil && onDisk {
+		// the hint is the only index of the merged segment
+		return fmt.Errorf("cannot write hint file of merged segment: %w", hintErr)
+	}
+	if hintErr != nil {
+		log.Printf("cannot write hint file of merged segment: %v", hintErr)
+	}
+	if onDisk {
+		disk, err := openDiskIndex(merged.hintPath(), hint.samples, hint.count, hint.offset)
+		if err != nil {
+			return err
+		}
+		merged.useDiskIndex(disk)
+	}
+
+	var filterErr error
+	if db.bloomFilterRate > 0 {
+		if filterErr = merged.buildFilter(db.bloomFilterRate); filterErr == nil {
+			filterErr = merged.writeFilter()
+		}
+		if filterErr != nil {
+			log.Printf("cannot write bloom filter file of merged segment: %v", filterErr)
 		}
 	}
 
@@ -338,18 +1253,36 @@ func (db *Db) merge() {
 	err = os.Rename(segmentPath, mergedPath)
 	if err != nil {
 		db.mux.Unlock()
-		fmt.Errorf("cannot merge files: %v", err)
-		return
+		return fmt.Errorf("cannot merge files: %w", err)
+	}
+	merged.path = mergedPath
+	if hintErr == nil {
+		if err := os.Rename(segmentPath+hintSuffix, merged.hintPath()); err != nil {
+			log.Printf("cannot move hint file of merged segment: %v", err)
+		}
+	}
+	if merged.filter != nil && filterErr == nil {
+		if err := os.Rename(segmentPath+bloomSuffix, merged.bloomPath()); err != nil {
+			log.Printf("cannot move bloom filter file of merged segment: %v", err)
+		}
 	}
-	segment.path = mergedPath
 	to := len(db.segments) - len(segments)
-	db.segments = append(db.segments[:to], segment)
+	db.segments = append(db.segments[:to], merged)
+
+	db.merges++
+	db.lastMerge = time.Now()
+	db.lastMergeDuration = db.lastMerge.Sub(start)
+	db.totalMergeDuration += db.lastMergeDuration
 
 	db.mux.Unlock()
 
 	for _, s := range segments {
+		s.close()
 		if mergedPath != s.path {
 			os.Remove(s.path)
+			s.removeHint()
+			s.removeFilter()
 		}
 	}
+	return nil
 }
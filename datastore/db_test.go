@@ -1,10 +1,22 @@
 package datastore
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"math"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 var (
@@ -35,6 +47,20 @@ var (
 	}
 )
 
+func segmentFiles(t *testing.T, dir string) []string {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var res []string
+	for _, fi := range files {
+		if isSegmentFile(fi.Name()) {
+			res = append(res, fi.Name())
+		}
+	}
+	return res
+}
+
 func TestDb_Put(t *testing.T) {
 	dir, err := ioutil.TempDir("", "test-db")
 	if err != nil {
@@ -89,7 +115,7 @@ func TestDb_Put(t *testing.T) {
 		if err != nil {
 			t.Fatal(err)
 		}
-		if size1 * 2 != outInfo.Size() {
+		if (size1-segmentHeaderSize)*2 != outInfo.Size()-segmentHeaderSize {
 			t.Errorf("Unexpected size (%d vs %d)", size1, outInfo.Size())
 		}
 	})
@@ -133,7 +159,7 @@ func TestDb_Segmentation(t *testing.T) {
 		}
 	}
 
-	files, err := ioutil.ReadDir(dir)
+	files := segmentFiles(t, dir)
 	if len(files) != 2 {
 		t.Errorf("Unexpected segment count (%d vs %d)", len(files), 2)
 	}
@@ -168,13 +194,13 @@ func TestDb_Merge(t *testing.T) {
 		}
 	}
 
-	files, err := ioutil.ReadDir(dir)
+	files := segmentFiles(t, dir)
 	if len(files) != 3 {
 		t.Errorf("Unexpected segment count before merge (%d vs %d)", len(files), 3)
 	}
 
 	db.merge()
-	files, err = ioutil.ReadDir(dir)
+	files = segmentFiles(t, dir)
 	if len(files) != 2 {
 		t.Errorf("Unexpected segment count after merge (%d vs %d)", len(files), 2)
 	}
@@ -324,3 +350,2652 @@ func TestDb_Delete(t *testing.T) {
 		t.Errorf("Value exists after merge %s: %s", deleteKey, err)
 	}
 }
+
+func TestDb_Recovery(t *testing.T) {
+	prepare := func(t *testing.T, damage func(path string, size int64)) string {
+		dir, err := ioutil.TempDir("", "test-db")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		db, err := NewDb(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, pair := range pairs {
+			if err := db.Put(pair[0], pair[1]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		path := filepath.Join(dir, segmentPrefix+activeSuffix)
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		damage(path, fi.Size())
+		return dir
+	}
+
+	tornTail := func(path string, size int64) {
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		f.Write((&entry{key: "key4", value: "value4"}).Encode()[:10])
+	}
+
+	damagedMiddle := func(path string, size int64) {
+		f, err := os.OpenFile(path, os.O_WRONLY, 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		// the first value byte of the second record
+		f.WriteAt([]byte{0}, size/3+12+4)
+	}
+
+	t.Run("fail", func(t *testing.T) {
+		dir := prepare(t, tornTail)
+		defer os.RemoveAll(dir)
+
+		_, err := NewDb(dir)
+		if !errors.Is(err, ErrCorrupted) {
+			t.Errorf("Database opened with torn tail: %v", err)
+		}
+	})
+
+	t.Run("truncate", func(t *testing.T) {
+		dir := prepare(t, tornTail)
+		defer os.RemoveAll(dir)
+
+		opts := DefaultOptions()
+		opts.Recovery = RecoverTruncate
+		db, err := NewDbWithOptions(dir, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(db.Corruptions()) != 1 || db.Corruptions()[0].Size != 10 {
+			t.Errorf("Unexpected corruptions %v", db.Corruptions())
+		}
+
+		if err := db.Put("key4", "value4"); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		db, err = NewDb(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		for _, pair := range append(pairs, []string{"key4", "value4"}) {
+			value, err := db.Get(pair[0])
+			if err != nil || value != pair[1] {
+				t.Errorf("Bad value returned expected %s, got %s (%v)", pair[1], value, err)
+			}
+		}
+	})
+
+	t.Run("skip", func(t *testing.T) {
+		dir := prepare(t, damagedMiddle)
+		defer os.RemoveAll(dir)
+
+		_, err := NewDb(dir)
+		if !errors.Is(err, ErrCorrupted) {
+			t.Errorf("Database opened with damaged record: %v", err)
+		}
+
+		opts := DefaultOptions()
+		opts.Recovery = RecoverSkip
+		db, err := NewDbWithOptions(dir, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		if len(db.Corruptions()) != 1 {
+			t.Errorf("Unexpected corruptions %v", db.Corruptions())
+		}
+
+		if _, err := db.Get(pairs[1][0]); err != ErrNotFound {
+			t.Errorf("Damaged record is available: %v", err)
+		}
+		for _, pair := range [][]string{pairs[0], pairs[2]} {
+			value, err := db.Get(pair[0])
+			if err != nil || value != pair[1] {
+				t.Errorf("Bad value returned expected %s, got %s (%v)", pair[1], value, err)
+			}
+		}
+	})
+}
+
+func TestDb_HintFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDbSizedMerge(dir, 44, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pair := range append(pairs, newPairs...) {
+		if err := db.Put(pair[0], pair[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.merge()
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// key3 is still in the active segment, the rest is merged
+	expected := map[string]string{"key1": "value1", "key2": "value3", "key3": "value4"}
+	check := func(t *testing.T) {
+		db, err := NewDbSizedMerge(dir, 44, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		for key, value := range expected {
+			v, err := db.Get(key)
+			if err != nil || v != value {
+				t.Errorf("Bad value returned expected %s, got %s (%v)", value, v, err)
+			}
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "segment-1"+hintSuffix)); !os.IsNotExist(err) {
+		t.Errorf("Hint file of merged away segment is not removed: %v", err)
+	}
+
+	t.Run("hint", func(t *testing.T) {
+		s := newSegment(filepath.Join(dir, "segment-merged"))
+		if err := s.loadHint(); err != nil {
+			t.Fatal(err)
+		}
+		check(t)
+	})
+
+	t.Run("stale hint", func(t *testing.T) {
+		f, err := os.OpenFile(filepath.Join(dir, "segment-merged"), os.O_APPEND|os.O_WRONLY, 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write((&entry{key: "key1", value: "value5"}).Encode())
+		f.Close()
+		expected["key1"] = "value5"
+
+		s := newSegment(filepath.Join(dir, "segment-merged"))
+		if err := s.loadHint(); err != errStaleHint {
+			t.Errorf("Stale hint file is loaded: %v", err)
+		}
+		check(t)
+	})
+
+	t.Run("missing hint", func(t *testing.T) {
+		if err := os.Remove(filepath.Join(dir, "segment-merged"+hintSuffix)); err != nil {
+			t.Fatal(err)
+		}
+		check(t)
+	})
+}
+
+func TestDb_Scan(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDbSizedMerge(dir, 46, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, pair := range morePairs {
+		if err := db.Put(pair[0], pair[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Put("key2", "value2-new"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("other", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("key5"); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(t *testing.T, prefix, start string, limit int, expected []string) {
+		keys, err := db.Scan(prefix, start, limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(keys, expected) {
+			t.Errorf("Unexpected keys %v, expected %v", keys, expected)
+		}
+	}
+
+	all := []string{"key1", "key10", "key11", "key12", "key2", "key3", "key4", "key6", "key7", "key8", "key9"}
+	t.Run("prefix", func(t *testing.T) {
+		check(t, "key", "", 0, all)
+		check(t, "key1", "", 0, all[:4])
+		check(t, "", "", 0, append(all, "other"))
+	})
+
+	t.Run("pages", func(t *testing.T) {
+		check(t, "key", "", 3, all[:3])
+		check(t, "key", "key12", 3, all[3:6])
+		check(t, "key", "key9\x00", 3, nil)
+	})
+
+	t.Run("pages over deleted keys", func(t *testing.T) {
+		// the page is taken from several batches of the index when the first ones have only deleted keys
+		for i := 0; i < 20; i++ {
+			if err := db.Put(fmt.Sprintf("page%02d", i), "value"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for i := 0; i < 15; i++ {
+			if err := db.Delete(fmt.Sprintf("page%02d", i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		check(t, "page", "", 2, []string{"page15", "page16"})
+		check(t, "page", "page16\x00", 2, []string{"page17", "page18"})
+		check(t, "page", "page18\x00", 2, []string{"page19"})
+		check(t, "page1", "", 0, []string{"page15", "page16", "page17", "page18", "page19"})
+	})
+
+	t.Run("merge", func(t *testing.T) {
+		// seal the segment with the tombstone, so it is merged too
+		for _, key := range []string{"z1", "z2", "z3"} {
+			if err := db.Put(key, "value"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if pos, ok := db.segments[0].index["key5"]; ok && pos == deletedItemPos {
+			t.Fatal("tombstone is still in the active segment")
+		}
+		db.merge()
+		check(t, "key", "", 0, all)
+	})
+}
+
+func TestDb_WriteBatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pair := range pairs {
+		if err := db.Put(pair[0], pair[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b := NewWriteBatch()
+	b.Put("key1", "batch1")
+	b.Delete("key2")
+	b.Put("key4", "batch4")
+	if err := db.Write(b); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{"key1": "batch1", "key3": "value3", "key4": "batch4"}
+	check := func(t *testing.T, db *Db, expected map[string]string) {
+		for key, value := range expected {
+			v, err := db.Get(key)
+			if err != nil || v != value {
+				t.Errorf("Bad value returned expected %s, got %s (%v)", value, v, err)
+			}
+		}
+		if _, err := db.Get("key2"); err != ErrNotFound {
+			t.Errorf("Deleted key is available: %v", err)
+		}
+	}
+	check(t, db, expected)
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("recover", func(t *testing.T) {
+		db, err := NewDb(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(t, db, expected)
+
+		b := NewWriteBatch()
+		b.Put("key3", "torn3")
+		b.Put("key5", "torn5")
+		if err := db.Write(b); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("torn batch", func(t *testing.T) {
+		path := filepath.Join(dir, segmentPrefix+activeSuffix)
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// cut the last batch right after its first record
+		if err := os.Truncate(path, fi.Size()-30); err != nil {
+			t.Fatal(err)
+		}
+
+		opts := DefaultOptions()
+		opts.Recovery = RecoverTruncate
+		db, err := NewDbWithOptions(dir, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		check(t, db, expected)
+		if _, err := db.Get("key5"); err != ErrNotFound {
+			t.Errorf("Part of torn batch is applied: %v", err)
+		}
+	})
+}
+
+func TestDb_PutWithTTL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	current := time.Now()
+	now = func() time.Time { return current }
+	defer func() { now = time.Now }()
+
+	db, err := NewDbSizedMerge(dir, 60, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Put("key1", "value1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutWithTTL("key1", "session1", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutWithTTL("key2", "session2", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutWithTTL("key3", "session3", 0); err == nil {
+		t.Error("Value with zero ttl is put")
+	}
+
+	if value, err := db.Get("key1"); err != nil || value != "session1" {
+		t.Errorf("Bad value returned expected %s, got %s (%v)", "session1", value, err)
+	}
+
+	current = current.Add(2 * time.Minute)
+
+	check := func(t *testing.T, db *Db) {
+		if _, err := db.Get("key1"); err != ErrNotFound {
+			t.Errorf("Expired value is available: %v", err)
+		}
+		if value, err := db.Get("key2"); err != nil || value != "session2" {
+			t.Errorf("Bad value returned expected %s, got %s (%v)", "session2", value, err)
+		}
+		keys, err := db.Scan("", "", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(keys, []string{"key2"}) {
+			t.Errorf("Unexpected keys %v", keys)
+		}
+	}
+
+	check(t, db)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = NewDbSizedMerge(dir, 60, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	check(t, db)
+
+	t.Run("merge", func(t *testing.T) {
+		if err := db.Put("key4", "value4"); err != nil {
+			t.Fatal(err)
+		}
+		db.merge()
+		if _, err := db.Get("key1"); err != ErrNotFound {
+			t.Errorf("Expired value is available after merge: %v", err)
+		}
+
+		if len(db.segments) != 2 {
+			t.Fatalf("Unexpected segment count after merge %d", len(db.segments))
+		}
+		merged := db.segments[1]
+		if _, ok := merged.index["key1"]; ok {
+			t.Error("Expired value is not dropped by merge")
+		}
+		if expiresAt := merged.expiry["key2"]; expiresAt != current.Add(-2*time.Minute).Add(time.Hour).UnixNano() {
+			t.Errorf("Expiration time is lost by merge: %d", expiresAt)
+		}
+	})
+}
+
+func TestDb_CompareAndSwap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v1, err := db.CompareAndSwap("key", 0, "value1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.CompareAndSwap("key", 0, "value2"); err != ErrVersionMismatch {
+		t.Errorf("Existing key is created again: %v", err)
+	}
+
+	value, version, err := db.GetWithVersion("key")
+	if err != nil || value != "value1" || version != v1 {
+		t.Errorf("Unexpected value %s with version %d (%v), expected version %d", value, version, err, v1)
+	}
+
+	if err := db.Put("other", "value"); err != nil {
+		t.Fatal(err)
+	}
+	v2, err := db.CompareAndSwap("key", v1, "value2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v2 <= v1+1 {
+		t.Errorf("Versions are not increasing: %d after %d", v2, v1)
+	}
+	if _, err := db.CompareAndSwap("key", v1, "value3"); err != ErrVersionMismatch {
+		t.Errorf("Value is swapped with outdated version: %v", err)
+	}
+
+	t.Run("concurrent updates", func(t *testing.T) {
+		if err := db.Put("counter", "0"); err != nil {
+			t.Fatal(err)
+		}
+
+		done := make(chan int)
+		for i := 0; i < 10; i++ {
+			go func() {
+				for {
+					value, version, err := db.GetWithVersion("counter")
+					if err != nil {
+						t.Error(err)
+						break
+					}
+					n, _ := strconv.Atoi(value)
+					_, err = db.CompareAndSwap("counter", version, strconv.Itoa(n+1))
+					if err != ErrVersionMismatch {
+						break
+					}
+				}
+				done <- 1
+			}()
+		}
+		for i := 0; i < 10; i++ {
+			<-done
+		}
+
+		if value, _ := db.Get("counter"); value != "10" {
+			t.Errorf("Lost updates, counter is %s", value)
+		}
+	})
+
+	t.Run("versions after restart", func(t *testing.T) {
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		db, err = NewDb(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		_, last, err := db.GetWithVersion("counter")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Put("key", "value4"); err != nil {
+			t.Fatal(err)
+		}
+		if _, version, _ := db.GetWithVersion("key"); version <= last {
+			t.Errorf("Version %d is given again after restart, last one is %d", version, last)
+		}
+	})
+
+	t.Run("versions of merged records", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "test-db")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		db, err := NewDbMerge(dir, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Put("a", "value"); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Put("b", "value"); err != nil {
+			t.Fatal(err)
+		}
+		_, deleted, err := db.GetWithVersion("b")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Delete("b"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.addSegment(); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Merge(); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		// the merged segment is read without its hint, which is the only other place of the dropped versions
+		if err := os.Remove(filepath.Join(dir, segmentPrefix+mergedSuffix+hintSuffix)); err != nil {
+			t.Fatal(err)
+		}
+		db, err = NewDbMerge(dir, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		if _, err := db.CompareAndSwap("b", deleted, "stale"); err != ErrVersionMismatch {
+			t.Errorf("Stale version %d is accepted: %v", deleted, err)
+		}
+		version, err := db.CompareAndSwap("b", 0, "value")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if version <= deleted+1 {
+			t.Errorf("Version %d is given again after merge, the tombstone had %d", version, deleted+1)
+		}
+		if keys, _ := db.Scan("", "", 0); len(keys) != 2 {
+			t.Errorf("Unexpected keys after merge: %v", keys)
+		}
+	})
+}
+
+func TestDb_Durability(t *testing.T) {
+	for name, durability := range map[string]Durability{"always": SyncAlways, "interval": SyncInterval} {
+		durability := durability
+		t.Run(name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "test-db")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			opts := DefaultOptions()
+			opts.ActiveBlockSize = 200
+			opts.Durability = durability
+			opts.SyncInterval = 10 * time.Millisecond
+			db, err := NewDbWithOptions(dir, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			done := make(chan error)
+			for _, pair := range morePairs {
+				pair := pair
+				go func() {
+					done <- db.Put(pair[0], pair[1])
+				}()
+			}
+			for range morePairs {
+				if err := <-done; err != nil {
+					t.Error(err)
+				}
+			}
+			time.Sleep(2 * opts.SyncInterval)
+
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			}
+			db, err = NewDbWithOptions(dir, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			for _, pair := range morePairs {
+				value, err := db.Get(pair[0])
+				if err != nil || value != pair[1] {
+					t.Errorf("Bad value returned expected %s, got %s (%v)", pair[1], value, err)
+				}
+			}
+		})
+	}
+}
+
+func TestDb_Backup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDbSizedMerge(dir, 100, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, pair := range morePairs {
+		if err := db.Put(pair[0], pair[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Delete("key1"); err != nil {
+		t.Fatal(err)
+	}
+
+	var backup bytes.Buffer
+	if err := db.Backup(&backup); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("key2", "changed"); err != nil {
+		t.Fatal(err)
+	}
+
+	restoreDir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(restoreDir)
+
+	if err := Restore(bytes.NewReader(backup.Bytes()), restoreDir); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(segmentFiles(t, restoreDir), segmentFiles(t, dir)) {
+		t.Errorf("Restored files %v, expected %v", segmentFiles(t, restoreDir), segmentFiles(t, dir))
+	}
+
+	restored, err := NewDb(restoreDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+
+	if _, err := restored.Get("key1"); err != ErrNotFound {
+		t.Errorf("Deleted key is restored: %v", err)
+	}
+	for _, pair := range morePairs[1:] {
+		value, err := restored.Get(pair[0])
+		if err != nil || value != pair[1] {
+			t.Errorf("Bad value returned expected %s, got %s (%v)", pair[1], value, err)
+		}
+	}
+
+	t.Run("not empty dir", func(t *testing.T) {
+		if err := Restore(bytes.NewReader(backup.Bytes()), dir); err == nil {
+			t.Error("Backup is restored over existing segments")
+		}
+	})
+
+	t.Run("broken archive", func(t *testing.T) {
+		brokenDir, err := ioutil.TempDir("", "test-db")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(brokenDir)
+
+		if err := Restore(bytes.NewReader(backup.Bytes()[:backup.Len()/2]), brokenDir); err == nil {
+			t.Error("Broken archive is restored")
+		}
+		if files := segmentFiles(t, brokenDir); len(files) != 0 {
+			t.Errorf("Broken archive left files %v", files)
+		}
+	})
+}
+
+func TestDb_Inspect(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDbSizedMerge(dir, 100, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pair := range morePairs {
+		if err := db.Put(pair[0], pair[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b := NewWriteBatch()
+	b.Put("key2", "batch")
+	b.Delete("key3")
+	if err := db.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("key1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	paths, err := SegmentFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last := filepath.Base(paths[len(paths)-1]); last != segmentPrefix+activeSuffix || len(paths) < 3 {
+		t.Fatalf("Unexpected segments order %v", paths)
+	}
+
+	var records []Record
+	for _, path := range paths {
+		corruptions, err := ReadSegment(path, func(r Record) {
+			records = append(records, r)
+		})
+		if err != nil || len(corruptions) != 0 {
+			t.Fatalf("Cannot read %s: %v %v", path, corruptions, err)
+		}
+	}
+	if len(records) != len(morePairs)+3 {
+		t.Fatalf("Expected %d records, got %d", len(morePairs)+3, len(records))
+	}
+	for i, r := range records {
+		if i > 0 && r.Version <= records[i-1].Version {
+			t.Errorf("Records are not in the write order: %+v after %+v", r, records[i-1])
+		}
+	}
+	last := records[len(records)-3:]
+	if !last[0].Batch || !last[1].Batch || !last[1].Deleted || last[2].Batch || !last[2].Deleted || last[2].Key != "key1" {
+		t.Errorf("Unexpected last records %+v", last)
+	}
+
+	active := paths[len(paths)-1]
+	f, err := os.OpenFile(active, os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{200, 0, 0, 0, 1, 2})
+	f.Close()
+
+	corruptions, err := ReadSegment(active, func(Record) {})
+	if err != nil || len(corruptions) != 1 || corruptions[0].Size != 6 {
+		t.Fatalf("Expected a corrupted tail of 6 bytes, got %v (%v)", corruptions, err)
+	}
+	removed, err := TruncateSegment(active)
+	if err != nil || removed != 6 {
+		t.Fatalf("Expected 6 bytes to be removed, got %d (%v)", removed, err)
+	}
+
+	if err := Compact(dir, DefaultOptions()); err != nil {
+		t.Fatal(err)
+	}
+	files := segmentFiles(t, dir)
+	if !reflect.DeepEqual(files, []string{segmentPrefix + activeSuffix, segmentPrefix + mergedSuffix}) {
+		t.Errorf("Unexpected segments after compaction %v", files)
+	}
+
+	db, err = NewDb(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	keys, err := db.Scan("", "", 0)
+	if err != nil || len(keys) != len(morePairs)-2 {
+		t.Errorf("Unexpected keys after compaction %v (%v)", keys, err)
+	}
+	if value, err := db.Get("key2"); err != nil || value != "batch" {
+		t.Errorf("Bad value returned expected batch, got %s (%v)", value, err)
+	}
+}
+
+func TestDb_Stats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDbMerge(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, pair := range append(pairs, newPairs...) {
+		if err := db.Put(pair[0], pair[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Delete("key1"); err != nil {
+		t.Fatal(err)
+	}
+	db.Get("key2")
+	db.Get("key1")
+
+	stats, err := db.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.LiveKeys != 2 || stats.Tombstones != 1 {
+		t.Errorf("Expected 2 live keys and 1 tombstone, got %d and %d", stats.LiveKeys, stats.Tombstones)
+	}
+	if len(stats.Segments) != 1 || stats.Segments[0].Records != 6 || stats.Segments[0].Keys != 3 {
+		t.Errorf("Unexpected segments %+v", stats.Segments)
+	}
+	live := len((&entry{key: "key2", value: "value3"}).Encode()) + len((&entry{key: "key3", value: "value4"}).Encode())
+	if reclaimable := stats.TotalBytes - segmentHeaderSize - int64(live); stats.ReclaimableBytes != reclaimable {
+		t.Errorf("Expected %d reclaimable bytes, got %d", reclaimable, stats.ReclaimableBytes)
+	}
+	if stats.Puts.Count != 6 || stats.Gets.Count != 2 || stats.Puts.Max < stats.Puts.Average() {
+		t.Errorf("Unexpected latencies: puts %+v, gets %+v", stats.Puts, stats.Gets)
+	}
+
+	t.Run("merge", func(t *testing.T) {
+		if _, err := db.addSegment(); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Put("key4", "value4"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.addSegment(); err != nil {
+			t.Fatal(err)
+		}
+		db.merge()
+
+		stats, err := db.Stats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.Merges != 1 || stats.LastMerge.IsZero() {
+			t.Errorf("Merge is not counted: %+v", stats)
+		}
+		if stats.LiveKeys != 3 || stats.Tombstones != 0 || stats.ReclaimableBytes != 0 {
+			t.Errorf("Garbage is left after merge: %+v", stats)
+		}
+	})
+}
+
+func TestDb_MergePolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := DefaultOptions()
+	opts.ActiveBlockSize = 100
+	opts.MergePolicy = GarbageRatioPolicy{Ratio: 0.6}
+	db, err := NewDbWithOptions(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// distinct keys don't make garbage, so nothing is merged
+	for _, pair := range morePairs {
+		if err := db.Put(pair[0], pair[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if state := db.mergeState(true); state.GarbageRatio != 0 || len(state.Segments) < 2 {
+		t.Fatalf("Unexpected merge state %+v", state)
+	}
+
+	for i := 0; i < 30; i++ {
+		if err := db.Put("key1", strconv.Itoa(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		stats, err := db.Stats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.Merges > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Garbage is not merged: %+v", db.mergeState(true))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Run("manual", func(t *testing.T) {
+		if err := db.Delete("key2"); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Merge(); err != nil {
+			t.Fatal(err)
+		}
+		stats, err := db.Stats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.Segments[len(stats.Segments)-1].Name != segmentPrefix+mergedSuffix {
+			t.Errorf("Unexpected segments after merge %+v", stats.Segments)
+		}
+		if value, err := db.Get("key1"); err != nil || value != "29" {
+			t.Errorf("Bad value returned expected 29, got %s (%v)", value, err)
+		}
+		if _, err := db.Get("key2"); err != ErrNotFound {
+			t.Errorf("Deleted key is available after merge: %v", err)
+		}
+		// the merged values hidden by the active segment can't be dropped, so they are not garbage
+		if state := db.mergeState(true); state.GarbageRatio != 0 {
+			t.Errorf("Unexpected garbage after merge %+v", state)
+		}
+	})
+}
+
+func TestDb_BloomFilters(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDbSizedMerge(dir, 100, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pair := range morePairs {
+		if err := db.Put(pair[0], pair[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Delete("key1"); err != nil {
+		t.Fatal(err)
+	}
+	sealed := db.segments[1]
+	if sealed.filter == nil {
+		t.Fatal("Sealed segment has no bloom filter")
+	}
+	if _, err := os.Stat(sealed.bloomPath()); err != nil {
+		t.Errorf("Bloom filter is not saved: %v", err)
+	}
+	for key := range sealed.index {
+		if !sealed.filter.mayContain(key) {
+			t.Errorf("%s is not in the bloom filter", key)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("reopen", func(t *testing.T) {
+		db, err := NewDbSizedMerge(dir, 100, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		for _, s := range db.segments {
+			if (s.filter == nil) != s.isActive() {
+				t.Errorf("Unexpected bloom filter of %s", s.path)
+			}
+		}
+		if _, err := db.Get("key1"); err != ErrNotFound {
+			t.Errorf("Deleted key is found: %v", err)
+		}
+		if _, err := db.Get("missing"); err != ErrNotFound {
+			t.Errorf("Missing key is found: %v", err)
+		}
+		for _, pair := range morePairs[1:] {
+			value, err := db.Get(pair[0])
+			if err != nil || value != pair[1] {
+				t.Errorf("Bad value returned expected %s, got %s (%v)", pair[1], value, err)
+			}
+		}
+
+		if err := db.Merge(); err != nil {
+			t.Fatal(err)
+		}
+		merged := db.segments[len(db.segments)-1]
+		if merged.filter == nil {
+			t.Fatal("Merged segment has no bloom filter")
+		}
+		if _, err := os.Stat(merged.bloomPath()); err != nil {
+			t.Errorf("Bloom filter of merged segment is not saved: %v", err)
+		}
+		if _, err := os.Stat(sealed.bloomPath()); !os.IsNotExist(err) {
+			t.Errorf("Bloom filter of merged away segment is not removed: %v", err)
+		}
+	})
+
+	t.Run("rate", func(t *testing.T) {
+		opts := DefaultOptions()
+		opts.BloomFilterRate = 0.0001
+		db, err := NewDbWithOptions(dir, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		merged := db.segments[len(db.segments)-1]
+		if expected := newBloomFilter(len(merged.index), opts.BloomFilterRate); merged.filter.k != expected.k {
+			t.Errorf("Bloom filter is not rebuilt for the new rate")
+		}
+	})
+}
+
+func TestDb_DiskIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := DefaultOptions()
+	opts.ActiveBlockSize = 4096
+	opts.AutoMergeEnabled = false
+	opts.IndexMode = IndexOnDisk
+	open := func(t *testing.T) *Db {
+		db, err := NewDbWithOptions(dir, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db
+	}
+	expected := make(map[string]string)
+	check := func(t *testing.T, db *Db) {
+		for _, s := range db.segments[1:] {
+			if s.index != nil || s.disk == nil {
+				t.Errorf("Sealed segment %s keeps its index in memory", s.path)
+			}
+		}
+		for key, value := range expected {
+			v, err := db.Get(key)
+			if err != nil || v != value {
+				t.Errorf("Bad value of %s returned expected %s, got %s (%v)", key, value, v, err)
+			}
+		}
+		for _, key := range []string{"key0000", "key0010", "key1000", "missing"} {
+			if _, err := db.Get(key); err != ErrNotFound {
+				t.Errorf("Deleted or missing %s is found: %v", key, err)
+			}
+		}
+		keys, err := db.Scan("key00", "", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(keys) != 98 || keys[0] != "key0001" || keys[97] != "key0099" {
+			t.Errorf("Unexpected scan result of %d keys: %v", len(keys), keys)
+		}
+	}
+
+	db := open(t)
+	for i := 0; i < 1000; i++ {
+		key, value := fmt.Sprintf("key%04d", i), fmt.Sprintf("value%d", i)
+		if err := db.Put(key, value); err != nil {
+			t.Fatal(err)
+		}
+		expected[key] = value
+	}
+	for i := 0; i < 1000; i += 3 {
+		key, value := fmt.Sprintf("key%04d", i), fmt.Sprintf("new%d", i)
+		if err := db.Put(key, value); err != nil {
+			t.Fatal(err)
+		}
+		expected[key] = value
+	}
+	for _, key := range []string{"key0000", "key0010"} {
+		if err := db.Delete(key); err != nil {
+			t.Fatal(err)
+		}
+		delete(expected, key)
+	}
+	if len(db.segments) < 3 {
+		t.Fatalf("Expected several sealed segments, got %d", len(db.segments)-1)
+	}
+	check(t, db)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("reopen", func(t *testing.T) {
+		db := open(t)
+		defer db.Close()
+		check(t, db)
+	})
+
+	t.Run("merge", func(t *testing.T) {
+		db := open(t)
+		defer db.Close()
+		if err := db.Merge(); err != nil {
+			t.Fatal(err)
+		}
+		check(t, db)
+		if stats, err := db.Stats(); err != nil || stats.LiveKeys != len(expected) {
+			t.Errorf("Expected %d live keys, got %+v (%v)", len(expected), stats, err)
+		}
+	})
+
+	t.Run("missing hint", func(t *testing.T) {
+		if err := os.Remove(filepath.Join(dir, "segment-merged"+hintSuffix)); err != nil {
+			t.Fatal(err)
+		}
+		db := open(t)
+		defer db.Close()
+		check(t, db)
+	})
+}
+
+func TestDb_Encryption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldKey, newKey := bytes.Repeat([]byte{1}, keySize), bytes.Repeat([]byte{2}, keySize)
+	open := func(t *testing.T, keys *Keyring) *Db {
+		opts := DefaultOptions()
+		opts.ActiveBlockSize = 100
+		opts.AutoMergeEnabled = false
+		opts.Keyring = keys
+		db, err := NewDbWithOptions(dir, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db
+	}
+	keyring := func(t *testing.T, current []byte, old ...[]byte) *Keyring {
+		keys, err := NewKeyring(current, old...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return keys
+	}
+	check := func(t *testing.T, db *Db) {
+		for _, pair := range append(pairs, []string{"plain", "value"}) {
+			value, err := db.Get(pair[0])
+			if err != nil || value != pair[1] {
+				t.Errorf("Bad value returned expected %s, got %s (%v)", pair[1], value, err)
+			}
+		}
+	}
+
+	// the values written before encryption is enabled stay readable
+	db := open(t, nil)
+	if err := db.Put("plain", "value"); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	db = open(t, keyring(t, oldKey))
+	for _, pair := range pairs {
+		if err := db.Put(pair[0], pair[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check(t, db)
+	db.Close()
+
+	paths, err := SegmentFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(data, []byte("value1")) || bytes.Contains(data, []byte("value3")) {
+			t.Errorf("Plain value is written to %s", path)
+		}
+	}
+
+	t.Run("without key", func(t *testing.T) {
+		db := open(t, nil)
+		defer db.Close()
+		if _, err := db.Get("key1"); err != ErrNoKey {
+			t.Errorf("Expected %v, got %v", ErrNoKey, err)
+		}
+		encrypted := 0
+		if _, err := ReadSegment(paths[0], func(r Record) {
+			if _, err := (*Keyring)(nil).Decrypt(r); r.Encrypted && err != ErrNoKey {
+				t.Errorf("Expected %v, got %v", ErrNoKey, err)
+			}
+			if r.Encrypted {
+				encrypted++
+			}
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if encrypted == 0 {
+			t.Errorf("No encrypted records in %s", paths[0])
+		}
+	})
+
+	t.Run("wrong key", func(t *testing.T) {
+		db := open(t, keyring(t, newKey))
+		defer db.Close()
+		if _, err := db.Get("key1"); err != ErrNoKey {
+			t.Errorf("Expected %v, got %v", ErrNoKey, err)
+		}
+	})
+
+	t.Run("rotation", func(t *testing.T) {
+		db := open(t, keyring(t, newKey, oldKey))
+		check(t, db)
+		if err := db.Merge(); err != nil {
+			t.Fatal(err)
+		}
+		check(t, db)
+		db.Close()
+
+		// everything merged is encrypted with the new key only
+		db = open(t, keyring(t, newKey))
+		defer db.Close()
+		check(t, db)
+	})
+
+	t.Run("bucket without key", func(t *testing.T) {
+		db := open(t, keyring(t, newKey))
+		docs, err := db.CreateBucket("docs")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := docs.CreateIndex("n"); err != nil {
+			t.Fatal(err)
+		}
+		if err := docs.Put("doc1", `{"n": 1}`); err != nil {
+			t.Fatal(err)
+		}
+		db.Close()
+
+		if err := Compact(dir, DefaultOptions()); err != nil {
+			t.Fatal(err)
+		}
+		db = open(t, nil)
+		docs, err = db.Bucket("docs")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := docs.Find("n", 1); err != ErrNoIndex {
+			t.Errorf("Expected %v, got %v", ErrNoIndex, err)
+		}
+		db.Close()
+
+		db = open(t, keyring(t, newKey))
+		defer db.Close()
+		if docs, err = db.Bucket("docs"); err != nil {
+			t.Fatal(err)
+		}
+		if keys, err := docs.Find("n", 1); err != nil || !reflect.DeepEqual(keys, []string{"doc1"}) {
+			t.Errorf("Unexpected keys %v: %v", keys, err)
+		}
+	})
+
+	t.Run("tampered", func(t *testing.T) {
+		e, err := keyring(t, oldKey).seal(&entry{key: "key", value: "value", version: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		moved := *e
+		moved.key = "other"
+		if err := keyring(t, oldKey).decrypt(&moved); !errors.Is(err, ErrCorrupted) {
+			t.Errorf("Value moved to another key is decrypted: %v", err)
+		}
+		changed := *e
+		changed.version = 2
+		if err := keyring(t, oldKey).decrypt(&changed); !errors.Is(err, ErrCorrupted) {
+			t.Errorf("Value with changed version is decrypted: %v", err)
+		}
+	})
+}
+
+func TestDb_Lock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewDb(dir); !errors.Is(err, ErrLocked) {
+		t.Errorf("Locked directory is opened: %v", err)
+	} else if !strings.Contains(err.Error(), strconv.Itoa(os.Getpid())) {
+		t.Errorf("Lock error doesn't name the owner: %v", err)
+	}
+	if err := Restore(bytes.NewReader(nil), dir); !errors.Is(err, ErrLocked) {
+		t.Errorf("Backup is restored to locked directory: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("reopen", func(t *testing.T) {
+		db, err := NewDb(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, lockFileName))
+		if err != nil || len(data) != 0 {
+			t.Errorf("Owner of the lock is not cleared: %q (%v)", data, err)
+		}
+	})
+
+	t.Run("stale", func(t *testing.T) {
+		// the lock file of a crashed process keeps its pid, but the lock itself is gone
+		if err := ioutil.WriteFile(filepath.Join(dir, lockFileName), []byte("999999"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		db, err := NewDb(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		data, err := ioutil.ReadFile(filepath.Join(dir, lockFileName))
+		if err != nil || string(data) != strconv.Itoa(os.Getpid()) {
+			t.Errorf("Lock owner is not replaced: %q (%v)", data, err)
+		}
+	})
+}
+
+func TestDb_Format(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the segments written before the header was introduced start right with the records
+	var legacy []byte
+	for _, pair := range pairs {
+		legacy = append(legacy, (&entry{key: pair[0], value: pair[1], version: 1}).Encode()...)
+	}
+	for _, name := range []string{"segment-0", "segment-active"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), legacy, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func(t *testing.T, db *Db) {
+		for _, pair := range pairs {
+			value, err := db.Get(pair[0])
+			if err != nil || value != pair[1] {
+				t.Errorf("Bad value returned expected %s, got %s (%v)", pair[1], value, err)
+			}
+		}
+	}
+
+	db, err := NewDbMerge(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(t, db)
+	if err := db.Put("key4", "value4"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if version, err := SegmentFormat(filepath.Join(dir, "segment-0")); err != nil || version != legacyFormat {
+		t.Errorf("Expected legacy format, got %d (%v)", version, err)
+	}
+
+	t.Run("upgrade", func(t *testing.T) {
+		upgraded, err := Upgrade(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(upgraded) != 2 {
+			t.Errorf("Expected 2 upgraded segments, got %v", upgraded)
+		}
+		for _, path := range upgraded {
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.HasPrefix(data, segmentHeader()) {
+				t.Errorf("%s doesn't start with the header", path)
+			}
+		}
+
+		db, err := NewDbMerge(dir, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		check(t, db)
+		if value, err := db.Get("key4"); err != nil || value != "value4" {
+			t.Errorf("Bad value returned expected value4, got %s (%v)", value, err)
+		}
+	})
+
+	t.Run("baseline", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "test-db")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		// the segment written by the baseline version of the database, which had neither metadata nor checksums
+		data, err := ioutil.ReadFile(filepath.Join("..", "segment-active"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(dir, "segment-active")
+		if err := ioutil.WriteFile(path, data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if version, err := SegmentFormat(path); err != nil || version != baselineFormat {
+			t.Errorf("Expected baseline format, got %d (%v)", version, err)
+		}
+
+		upgraded, err := Upgrade(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(upgraded) != 1 {
+			t.Errorf("Expected 1 upgraded segment, got %v", upgraded)
+		}
+		if version, err := SegmentFormat(path); err != nil || version != FormatVersion {
+			t.Errorf("Expected format %d, got %d (%v)", FormatVersion, version, err)
+		}
+
+		opts := DefaultOptions()
+		opts.Recovery = RecoverFail
+		db, err := NewDbWithOptions(dir, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		for key, expected := range map[string]string{"agb": "2021-05-27", "agb123": "123123123"} {
+			if value, err := db.Get(key); err != nil || value != expected {
+				t.Errorf("Bad value returned expected %s, got %s (%v)", expected, value, err)
+			}
+		}
+	})
+
+	t.Run("baseline without upgrade", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "test-db")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		data, err := ioutil.ReadFile(filepath.Join("..", "segment-active"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "segment-active"), data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+
+		// the baseline records have no checksums, but they are not corrupted
+		opts := DefaultOptions()
+		opts.Recovery = RecoverFail
+		db, err := NewDbWithOptions(dir, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c := db.Corruptions(); len(c) != 0 {
+			t.Errorf("Baseline records are reported as corrupted: %v", c)
+		}
+		// the baseline records exist, so they can't be created again
+		if _, err := db.CompareAndSwap("agb", 0, "created"); err != ErrVersionMismatch {
+			t.Errorf("Baseline record is created again: %v", err)
+		}
+		_, version, err := db.GetWithVersion("agb123")
+		if err != nil || version == 0 {
+			t.Fatalf("Baseline record has version %d (%v)", version, err)
+		}
+		if _, err := db.CompareAndSwap("agb123", version, "123123123"); err != nil {
+			t.Errorf("Baseline record is not swapped: %v", err)
+		}
+		if err := db.Put("key1", "value1"); err != nil {
+			t.Fatal(err)
+		}
+		check := func(t *testing.T, db *Db) {
+			for key, expected := range map[string]string{"agb": "2021-05-27", "agb123": "123123123", "key1": "value1"} {
+				if value, err := db.Get(key); err != nil || value != expected {
+					t.Errorf("Bad value returned expected %s, got %s (%v)", expected, value, err)
+				}
+			}
+			r, err := db.GetStream("agb")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+			if value, err := ioutil.ReadAll(r); err != nil || string(value) != "2021-05-27" {
+				t.Errorf("Bad stream returned expected 2021-05-27, got %s (%v)", value, err)
+			}
+		}
+		check(t, db)
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		// the new records are not appended to the baseline segment, it's sealed on open
+		if version, err := SegmentFormat(filepath.Join(dir, "segment-0")); err != nil || version != baselineFormat {
+			t.Errorf("Expected baseline format, got %d (%v)", version, err)
+		}
+		if version, err := SegmentFormat(filepath.Join(dir, "segment-active")); err != nil || version != FormatVersion {
+			t.Errorf("Expected format %d, got %d (%v)", FormatVersion, version, err)
+		}
+		db, err = NewDbWithOptions(dir, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		check(t, db)
+	})
+
+	t.Run("new version", func(t *testing.T) {
+		header := segmentHeader()
+		binary.LittleEndian.PutUint32(header[8:], FormatVersion+1)
+		if err := ioutil.WriteFile(filepath.Join(dir, "segment-1"), header, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(filepath.Join(dir, "segment-1"))
+		if _, err := NewDb(dir); err == nil || errors.Is(err, ErrCorrupted) {
+			t.Errorf("Segment of unknown format is opened: %v", err)
+		}
+	})
+
+	t.Run("torn header", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "test-db")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		if err := ioutil.WriteFile(filepath.Join(dir, "segment-active"), segmentHeader()[:6], 0o600); err != nil {
+			t.Fatal(err)
+		}
+
+		opts := DefaultOptions()
+		opts.Recovery = RecoverTruncate
+		db, err := NewDbWithOptions(dir, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		if err := db.Put("key1", "value1"); err != nil {
+			t.Fatal(err)
+		}
+		if version, err := SegmentFormat(filepath.Join(dir, "segment-active")); err != nil || version != FormatVersion {
+			t.Errorf("Expected format %d, got %d (%v)", FormatVersion, version, err)
+		}
+	})
+}
+
+func TestDb_Stream(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDbSizedMerge(dir, 1024, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	value := bytes.Repeat([]byte("0123456789abcdef"), 64*1024)
+	if err := db.Put("small", "value"); err != nil {
+		t.Fatal(err)
+	}
+	before := db.LastVersion()
+	if err := db.PutStream("big", bytes.NewReader(value), int64(len(value))); err != nil {
+		t.Fatal(err)
+	}
+	read := func(t *testing.T, r *ValueReader) []byte {
+		defer r.Close()
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	r, err := db.GetStream("big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Size() != int64(len(value)) || r.Version() != before+1 {
+		t.Errorf("Unexpected size %d and version %d", r.Size(), r.Version())
+	}
+	if !bytes.Equal(read(t, r), value) {
+		t.Error("Streamed value differs from the written one")
+	}
+	if v, err := db.Get("big"); err != nil || v != string(value) {
+		t.Errorf("Streamed value is not returned by Get: %v", err)
+	}
+
+	// the streamed record is sent to followers from the segment file
+	records, err := db.Changes(before, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	followerDir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(followerDir)
+	follower, err := NewDb(followerDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer follower.Close()
+	if last, err := follower.ApplyChanges(records); err != nil || last != before+1 {
+		t.Errorf("Unexpected last applied version %d (%v)", last, err)
+	}
+	if v, err := follower.Get("big"); err != nil || v != string(value) {
+		t.Errorf("Streamed value is not replicated: %v", err)
+	}
+
+	t.Run("short reader", func(t *testing.T) {
+		err := db.PutStream("short", bytes.NewReader(value[:10]), 20)
+		if !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("Expected %v, got %v", io.ErrUnexpectedEOF, err)
+		}
+		if _, err := db.GetStream("short"); err != ErrNotFound {
+			t.Errorf("Short value is written: %v", err)
+		}
+		if matches, _ := filepath.Glob(filepath.Join(dir, "*"+streamSuffix)); len(matches) != 0 {
+			t.Errorf("Spooled values are left: %v", matches)
+		}
+	})
+
+	t.Run("merge", func(t *testing.T) {
+		r, err := db.GetStream("big")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Merge(); err != nil {
+			t.Fatal(err)
+		}
+		// the reader keeps the merged away segment open
+		if !bytes.Equal(read(t, r), value) {
+			t.Error("Value read during merge differs from the written one")
+		}
+		if _, err := db.Changes(before, 0); err != ErrLogTruncated {
+			t.Errorf("Expected %v for the merged away streamed record, got %v", ErrLogTruncated, err)
+		}
+		r, err = db.GetStream("small")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data := read(t, r); string(data) != "value" {
+			t.Errorf("Bad value returned expected value, got %s", data)
+		}
+	})
+
+	t.Run("corrupted", func(t *testing.T) {
+		f, err := os.OpenFile(db.segments[1].path, os.O_RDWR, 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.WriteAt([]byte("X"), db.segments[1].offset/2)
+		f.Close()
+
+		r, err := db.GetStream("big")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		if _, err := ioutil.ReadAll(r); err != ErrCorrupted {
+			t.Errorf("Expected %v, got %v", ErrCorrupted, err)
+		}
+	})
+}
+
+func TestDb_Buckets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDbSizedMerge(dir, 256, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { db.Close() }()
+
+	users, err := db.CreateBucket("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	orders, err := db.CreateBucket("orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("key1", "flat"); err != nil {
+		t.Fatal(err)
+	}
+	for _, pair := range pairs {
+		if err := users.Put(pair[0], pair[1]); err != nil {
+			t.Fatal(err)
+		}
+		if err := orders.Put(pair[0], "order-"+pair[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("separate keyspaces", func(t *testing.T) {
+		for _, key := range []string{"key1", "key2"} {
+			if v, err := users.Get(key); err != nil || v != "value"+key[3:] {
+				t.Errorf("Bad value of %s in users: %s, %v", key, v, err)
+			}
+			if v, err := orders.Get(key); err != nil || v != "order-value"+key[3:] {
+				t.Errorf("Bad value of %s in orders: %s, %v", key, v, err)
+			}
+		}
+		if v, err := db.Get("key1"); err != nil || v != "flat" {
+			t.Errorf("Bad value of the flat key: %s, %v", v, err)
+		}
+		if keys, err := db.Scan("", "", 0); err != nil || !reflect.DeepEqual(keys, []string{"key1"}) {
+			t.Errorf("Unexpected flat keys %v: %v", keys, err)
+		}
+		if keys, err := users.Scan("key", "key2", 0); err != nil || !reflect.DeepEqual(keys, []string{"key2", "key3"}) {
+			t.Errorf("Unexpected bucket keys %v: %v", keys, err)
+		}
+		if buckets, err := db.Buckets(); err != nil || !reflect.DeepEqual(buckets, []string{"orders", "users"}) {
+			t.Errorf("Unexpected buckets %v: %v", buckets, err)
+		}
+		if err := db.Put(bucketKey("users", "key1"), "value"); err != ErrReservedKey {
+			t.Errorf("Expected %v, got %v", ErrReservedKey, err)
+		}
+		if _, err := db.Bucket("missing"); err != ErrBucketNotFound {
+			t.Errorf("Expected %v, got %v", ErrBucketNotFound, err)
+		}
+	})
+
+	t.Run("drop", func(t *testing.T) {
+		if err := db.DropBucket("users"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := users.Get("key1"); err != ErrNotFound {
+			t.Errorf("Expected %v, got %v", ErrNotFound, err)
+		}
+		if err := users.Put("key1", "value"); err != ErrBucketNotFound {
+			t.Errorf("Expected %v, got %v", ErrBucketNotFound, err)
+		}
+		if err := db.DropBucket("users"); err != ErrBucketNotFound {
+			t.Errorf("Expected %v, got %v", ErrBucketNotFound, err)
+		}
+		if buckets, err := db.Buckets(); err != nil || !reflect.DeepEqual(buckets, []string{"orders"}) {
+			t.Errorf("Unexpected buckets %v: %v", buckets, err)
+		}
+
+		// the bucket is empty once it's created again
+		users, err = db.CreateBucket("users")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if keys, err := users.Scan("", "", 0); err != nil || len(keys) != 0 {
+			t.Errorf("Unexpected keys of the created bucket %v: %v", keys, err)
+		}
+		if err := db.DropBucket("users"); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("merge", func(t *testing.T) {
+		if _, err := db.addSegment(); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Merge(); err != nil {
+			t.Fatal(err)
+		}
+		kept := 0
+		_, err := ReadSegment(filepath.Join(dir, segmentPrefix+mergedSuffix), func(r Record) {
+			if strings.HasPrefix(r.Key, bucketKey("users", "")) || r.Key == bucketRegistryPrefix+"users" {
+				t.Errorf("Record %q of the dropped bucket is left after merge", r.Key)
+			}
+			kept++
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the flat key, the orders and their registry record
+		if kept != len(pairs)+2 {
+			t.Errorf("Expected %d records after merge, got %d", len(pairs)+2, kept)
+		}
+	})
+
+	t.Run("reopen", func(t *testing.T) {
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		db, err = NewDbSizedMerge(dir, 256, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		orders, err := db.Bucket("orders")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v, err := orders.Get("key3"); err != nil || v != "order-value3" {
+			t.Errorf("Bad value of key3 in orders: %s, %v", v, err)
+		}
+		if _, err := db.Bucket("users"); err != ErrBucketNotFound {
+			t.Errorf("Expected %v, got %v", ErrBucketNotFound, err)
+		}
+	})
+
+	t.Run("drop in batches", func(t *testing.T) {
+		defer func(size int) { dropChunkSize = size }(dropChunkSize)
+		dropChunkSize = 2
+
+		orders, err := db.Bucket("orders")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, pair := range append(pairs, newPairs...) {
+			if err := orders.Put(pair[0], pair[1]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := db.DropBucket("orders"); err != nil {
+			t.Fatal(err)
+		}
+		if keys, err := db.scan(bucketKey("orders", ""), "", 0); err != nil || len(keys) != 0 {
+			t.Errorf("Keys of the dropped bucket are left %v: %v", keys, err)
+		}
+		if _, err := db.Bucket("orders"); err != ErrBucketNotFound {
+			t.Errorf("Expected %v, got %v", ErrBucketNotFound, err)
+		}
+	})
+}
+
+func TestDb_SecondaryIndexes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDbSizedMerge(dir, 256, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { db.Close() }()
+
+	users, err := db.CreateBucket("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	docs := map[string]string{
+		"ann":   `{"age": 30, "address": {"city": "Kyiv"}}`,
+		"bob":   `{"age": 25, "address": {"city": "Lviv"}}`,
+		"carl":  `{"age": 41, "address": {"city": "Kyiv"}}`,
+		"dana":  `{"age": "unknown"}`,
+		"plain": "not a json",
+	}
+	for key, doc := range docs {
+		if err := users.Put(key, doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the index is built from the values already written
+	if err := users.CreateIndex("address.city"); err != nil {
+		t.Fatal(err)
+	}
+	if err := users.CreateIndex("age"); err != nil {
+		t.Fatal(err)
+	}
+	if err := users.Put("eve", `{"age": 19, "address": {"city": "Kyiv"}}`); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(t *testing.T, keys []string, err error, expected []string) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(keys)+len(expected) > 0 && !reflect.DeepEqual(keys, expected) {
+			t.Errorf("Unexpected keys %v, expected %v", keys, expected)
+		}
+	}
+
+	t.Run("find", func(t *testing.T) {
+		keys, err := users.Find("address.city", "Kyiv")
+		check(t, keys, err, []string{"ann", "carl", "eve"})
+		keys, err = users.FindRange("age", 20, 40)
+		check(t, keys, err, []string{"bob", "ann"})
+		// the range with a single bound keeps to the json type of the bound
+		keys, err = users.FindRange("age", 30, nil)
+		check(t, keys, err, []string{"ann", "carl"})
+		keys, err = users.FindRange("age", nil, 30)
+		check(t, keys, err, []string{"eve", "bob", "ann"})
+		keys, err = users.FindRange("age", nil, "v")
+		check(t, keys, err, []string{"dana"})
+		keys, err = users.FindRange("age", nil, nil)
+		check(t, keys, err, []string{"eve", "bob", "ann", "carl", "dana"})
+		if _, err := users.Find("name", "ann"); err != ErrNoIndex {
+			t.Errorf("Expected %v, got %v", ErrNoIndex, err)
+		}
+	})
+
+	t.Run("update", func(t *testing.T) {
+		if err := users.Put("ann", `{"age": 31, "address": {"city": "Lviv"}}`); err != nil {
+			t.Fatal(err)
+		}
+		if err := users.Delete("carl"); err != nil {
+			t.Fatal(err)
+		}
+		value := `{"age": 50, "address": {"city": "Kyiv"}}`
+		if err := users.PutStream("fred", strings.NewReader(value), int64(len(value))); err != nil {
+			t.Fatal(err)
+		}
+		if err := users.PutWithTTL("gus", `{"address": {"city": "Kyiv"}}`, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+
+		keys, err := users.Find("address.city", "Kyiv")
+		check(t, keys, err, []string{"eve", "fred", "gus"})
+
+		defer func() { now = time.Now }()
+		now = func() time.Time { return time.Now().Add(time.Hour) }
+		keys, err = users.Find("address.city", "Kyiv")
+		check(t, keys, err, []string{"eve", "fred"})
+	})
+
+	t.Run("reopen", func(t *testing.T) {
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		db, err = NewDbSizedMerge(dir, 256, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		users, err = db.Bucket("users")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if paths, err := users.Indexes(); err != nil || !reflect.DeepEqual(paths, []string{"address.city", "age"}) {
+			t.Errorf("Unexpected indexes %v: %v", paths, err)
+		}
+		keys, err := users.FindRange("age", 20, 40)
+		check(t, keys, err, []string{"bob", "ann"})
+	})
+
+	t.Run("drop", func(t *testing.T) {
+		if err := users.DropIndex("age"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := users.FindRange("age", 20, 40); err != ErrNoIndex {
+			t.Errorf("Expected %v, got %v", ErrNoIndex, err)
+		}
+		if err := users.DropIndex("age"); err != ErrNoIndex {
+			t.Errorf("Expected %v, got %v", ErrNoIndex, err)
+		}
+		if err := db.DropBucket("users"); err != nil {
+			t.Fatal(err)
+		}
+		users, err = db.CreateBucket("users")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if paths, err := users.Indexes(); err != nil || len(paths) != 0 {
+			t.Errorf("Unexpected indexes of the created bucket %v: %v", paths, err)
+		}
+	})
+}
+
+func TestDb_ReadOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDbSizedMerge(dir, 1024, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, pair := range pairs {
+		if err := db.Put(pair[0], pair[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.addSegment(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("key1", "value1-new"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the record the writer hasn't finished yet
+	active := filepath.Join(dir, segmentPrefix+activeSuffix)
+	f, err := os.OpenFile(active, os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{100, 0, 0, 0, 4})
+	f.Close()
+	activeInfo, err := os.Stat(active)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := DefaultOptions()
+	opts.ReadOnly = true
+	reader, err := NewDbWithOptions(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	diskOpts := opts
+	diskOpts.IndexMode = IndexOnDisk
+	diskReader, err := NewDbWithOptions(dir, diskOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer diskReader.Close()
+
+	check := func(t *testing.T) {
+		for key, expected := range map[string]string{"key1": "value1-new", "key2": "value2", "key3": "value3"} {
+			if value, err := reader.Get(key); err != nil || value != expected {
+				t.Errorf("Bad value of %s: %s, %v", key, value, err)
+			}
+		}
+	}
+	check(t)
+	if fi, err := os.Stat(active); err != nil || fi.Size() != activeInfo.Size() {
+		t.Errorf("Active segment is changed by the read-only database: %v", err)
+	}
+
+	t.Run("writes", func(t *testing.T) {
+		if err := reader.Put("key1", "value"); err != ErrReadOnly {
+			t.Errorf("Expected %v from put, got %v", ErrReadOnly, err)
+		}
+		if err := reader.Delete("key2"); err != ErrReadOnly {
+			t.Errorf("Expected %v from delete, got %v", ErrReadOnly, err)
+		}
+		if err := reader.PutStream("key1", strings.NewReader("value"), 5); err != ErrReadOnly {
+			t.Errorf("Expected %v from put stream, got %v", ErrReadOnly, err)
+		}
+		if _, err := reader.CreateBucket("bucket"); err != ErrReadOnly {
+			t.Errorf("Expected %v from bucket creation, got %v", ErrReadOnly, err)
+		}
+		if err := reader.Merge(); err != ErrReadOnly {
+			t.Errorf("Expected %v from merge, got %v", ErrReadOnly, err)
+		}
+		check(t)
+	})
+
+	t.Run("merged by writer", func(t *testing.T) {
+		if err := db.Merge(); err != nil {
+			t.Fatal(err)
+		}
+		check(t)
+
+		// the removed segment files are still read through the handles opened before the merge
+		r, err := reader.GetStream("key2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		value, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil || string(value) != "value2" {
+			t.Errorf("Bad stream of key2: %s, %v", value, err)
+		}
+		if err := reader.Backup(ioutil.Discard); err != nil {
+			t.Errorf("Cannot back up the read-only database: %v", err)
+		}
+		snapshot, err := reader.Snapshot()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer snapshot.Close()
+		if _, err := snapshot.WriteTo(ioutil.Discard); err != nil {
+			t.Errorf("Cannot write the snapshot: %v", err)
+		}
+		check(t)
+
+		// the hints of the removed segments are kept open too
+		if keys, err := diskReader.Scan("", "", 0); err != nil || len(keys) != len(pairs) {
+			t.Errorf("Unexpected keys of the disk index %v: %v", keys, err)
+		}
+		if value, err := diskReader.Get("key2"); err != nil || value != "value2" {
+			t.Errorf("Bad value of key2: %s, %v", value, err)
+		}
+	})
+
+	t.Run("index of another file", func(t *testing.T) {
+		// the index applied to another file points to the records of other keys
+		s := reader.segments[len(reader.segments)-1]
+		s.index["key2"], s.index["key3"] = s.index["key3"], s.index["key2"]
+		defer func() {
+			s.index["key2"], s.index["key3"] = s.index["key3"], s.index["key2"]
+		}()
+		if value, err := reader.Get("key2"); !errors.Is(err, ErrCorrupted) {
+			t.Errorf("Value of another key is returned: %s, %v", value, err)
+		}
+		if _, err := reader.GetStream("key3"); !errors.Is(err, ErrCorrupted) {
+			t.Errorf("Value of another key is streamed: %v", err)
+		}
+	})
+
+	t.Run("empty dir", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "test-db")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		db, err := NewDbWithOptions(dir, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Get("key1"); err != ErrNotFound {
+			t.Errorf("Expected %v, got %v", ErrNotFound, err)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if files, err := ioutil.ReadDir(dir); err != nil || len(files) != 0 {
+			t.Errorf("Files are created in the read-only database dir: %d, %v", len(files), err)
+		}
+	})
+}
+
+func TestDb_Context(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// block keeps the put goroutine busy until release is closed
+	block := func() (chan struct{}, chan error) {
+		started, release := make(chan struct{}), make(chan struct{})
+		result := make(chan error, 1)
+		go func() {
+			result <- db.send(putEntry{prepare: func() ([]*entry, error) {
+				close(started)
+				<-release
+				return []*entry{{key: "blocked", value: "value"}}, nil
+			}})
+		}()
+		<-started
+		return release, result
+	}
+
+	t.Run("canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if err := db.PutContext(ctx, "key1", "value1"); err != context.Canceled {
+			t.Errorf("Expected %v, got %v", context.Canceled, err)
+		}
+		if _, err := db.GetContext(ctx, "key1"); err != context.Canceled {
+			t.Errorf("Expected %v, got %v", context.Canceled, err)
+		}
+		if _, _, err := db.GetWithVersionContext(ctx, "key1"); err != context.Canceled {
+			t.Errorf("Expected %v, got %v", context.Canceled, err)
+		}
+		if _, err := db.GetStreamContext(ctx, "key1"); err != context.Canceled {
+			t.Errorf("Expected %v, got %v", context.Canceled, err)
+		}
+		if err := db.PutWithTTLContext(ctx, "key1", "value1", time.Hour); err != context.Canceled {
+			t.Errorf("Expected %v, got %v", context.Canceled, err)
+		}
+		if err := db.PutStreamContext(ctx, "key1", strings.NewReader("value1"), 6); !errors.Is(err, context.Canceled) {
+			t.Errorf("Expected %v, got %v", context.Canceled, err)
+		}
+		if _, err := db.CompareAndSwapContext(ctx, "key1", 0, "value1"); err != context.Canceled {
+			t.Errorf("Expected %v, got %v", context.Canceled, err)
+		}
+		if _, err := db.IncrementContext(ctx, "key1", 1); err != context.Canceled {
+			t.Errorf("Expected %v, got %v", context.Canceled, err)
+		}
+		if err := db.AppendContext(ctx, "key1", "value1"); err != context.Canceled {
+			t.Errorf("Expected %v, got %v", context.Canceled, err)
+		}
+		b := NewWriteBatch()
+		b.Put("key1", "value1")
+		if err := db.WriteContext(ctx, b); err != context.Canceled {
+			t.Errorf("Expected %v, got %v", context.Canceled, err)
+		}
+		if _, err := db.Get("key1"); err != ErrNotFound {
+			t.Errorf("Value is put with canceled context: %v", err)
+		}
+	})
+
+	t.Run("deadline", func(t *testing.T) {
+		release, result := block()
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		if err := db.PutContext(ctx, "key1", "value1"); err != context.DeadlineExceeded {
+			t.Errorf("Expected %v, got %v", context.DeadlineExceeded, err)
+		}
+		close(release)
+		if err := <-result; err != nil {
+			t.Fatal(err)
+		}
+		if err := db.PutContext(context.Background(), "key2", "value2"); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.DeleteContext(context.Background(), "key2"); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("stream", func(t *testing.T) {
+		release, result := block()
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		if err := db.PutStreamContext(ctx, "key1", strings.NewReader("value1"), 6); err != context.DeadlineExceeded {
+			t.Errorf("Expected %v, got %v", context.DeadlineExceeded, err)
+		}
+		close(release)
+		if err := <-result; err != nil {
+			t.Fatal(err)
+		}
+		if spooled, _ := filepath.Glob(filepath.Join(dir, "*"+streamSuffix)); len(spooled) > 0 {
+			t.Errorf("Spooled values are left: %v", spooled)
+		}
+	})
+
+	t.Run("close", func(t *testing.T) {
+		release, result := block()
+		type put struct {
+			key string
+			err error
+		}
+		puts := make(chan put, len(pairs))
+		for _, pair := range pairs {
+			go func(key, value string) {
+				puts <- put{key: key, err: db.Put(key, value)}
+			}(pair[0], pair[1])
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		if err := db.CloseContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Expected %v while put is in flight, got %v", context.DeadlineExceeded, err)
+		}
+		close(release)
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := <-result; err != nil {
+			t.Errorf("Put in flight is not written: %v", err)
+		}
+
+		// the puts which came after Close fail, the others are written
+		var written []string
+		for range pairs {
+			p := <-puts
+			if p.err == nil {
+				written = append(written, p.key)
+			} else if p.err != ErrClosed {
+				t.Errorf("Expected %v, got %v", ErrClosed, p.err)
+			}
+		}
+		if err := db.Put("key1", "value1"); err != ErrClosed {
+			t.Errorf("Expected %v, got %v", ErrClosed, err)
+		}
+		if err := db.Merge(); err != ErrClosed {
+			t.Errorf("Expected %v, got %v", ErrClosed, err)
+		}
+		// the reads don't open the closed files again
+		if _, err := db.Get(pairs[0][0]); err != ErrClosed {
+			t.Errorf("Expected %v from Get, got %v", ErrClosed, err)
+		}
+		if _, err := db.GetStream(pairs[0][0]); err != ErrClosed {
+			t.Errorf("Expected %v from GetStream, got %v", ErrClosed, err)
+		}
+		if _, err := db.Scan("", "", 0); err != ErrClosed {
+			t.Errorf("Expected %v from Scan, got %v", ErrClosed, err)
+		}
+
+		db, err = NewDb(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		for _, key := range written {
+			if _, err := db.Get(key); err != nil {
+				t.Errorf("Acknowledged put of %s is lost: %v", key, err)
+			}
+		}
+		if value, err := db.Get("blocked"); err != nil || value != "value" {
+			t.Errorf("Put in flight is lost: %v", err)
+		}
+	})
+
+	t.Run("merge", func(t *testing.T) {
+		open := func(t *testing.T) *Db {
+			dir, err := ioutil.TempDir("", "test-db")
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { os.RemoveAll(dir) })
+			db, err := NewDbSizedMerge(dir, 46, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, pair := range morePairs {
+				if err := db.Put(pair[0], pair[1]); err != nil {
+					t.Fatal(err)
+				}
+			}
+			return db
+		}
+		// startMerge runs the merge which waits for release once its files are open
+		startMerge := func(db *Db) (chan struct{}, chan error) {
+			started, release := make(chan struct{}), make(chan struct{})
+			var once sync.Once
+			now = func() time.Time {
+				once.Do(func() {
+					close(started)
+					<-release
+				})
+				return time.Now()
+			}
+			result := make(chan error, 1)
+			go func() {
+				result <- db.Merge()
+			}()
+			<-started
+			return release, result
+		}
+		defer func() { now = time.Now }()
+
+		t.Run("wait", func(t *testing.T) {
+			db := open(t)
+			release, result := startMerge(db)
+			closed := make(chan error, 1)
+			go func() {
+				closed <- db.Close()
+			}()
+			<-db.mergeStop
+			close(release)
+			if err := <-result; err != nil {
+				t.Errorf("Merge is not finished on close: %v", err)
+			}
+			if err := <-closed; err != nil {
+				t.Fatal(err)
+			}
+		})
+
+		t.Run("abort", func(t *testing.T) {
+			db := open(t)
+			release, result := startMerge(db)
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			if err := db.CloseContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("Expected %v while merge is running, got %v", context.DeadlineExceeded, err)
+			}
+			close(release)
+			if err := <-result; err != ErrClosed {
+				t.Errorf("Expected %v from aborted merge, got %v", ErrClosed, err)
+			}
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	})
+}
+
+func TestDb_Increment(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	t.Run("concurrent", func(t *testing.T) {
+		const workers, increments = 8, 50
+		var wg sync.WaitGroup
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < increments; j++ {
+					if _, err := db.Increment("counter", 2); err != nil {
+						t.Error(err)
+					}
+					if err := db.Append("log", "x"); err != nil {
+						t.Error(err)
+					}
+				}
+			}()
+		}
+		wg.Wait()
+
+		if value, err := db.Get("counter"); err != nil || value != strconv.Itoa(workers*increments*2) {
+			t.Errorf("Bad counter value %s: %v", value, err)
+		}
+		if value, err := db.Get("log"); err != nil || value != strings.Repeat("x", workers*increments) {
+			t.Errorf("Bad appended value of %d bytes: %v", len(value), err)
+		}
+	})
+
+	t.Run("bad value", func(t *testing.T) {
+		if err := db.Put("text", "value"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Increment("text", 1); err != ErrNotInteger {
+			t.Errorf("Expected %v, got %v", ErrNotInteger, err)
+		}
+		if err := db.Put("big", strconv.FormatInt(math.MaxInt64-1, 10)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Increment("big", 2); err != ErrOverflow {
+			t.Errorf("Expected %v, got %v", ErrOverflow, err)
+		}
+		if n, err := db.Increment("big", -1); err != nil || n != math.MaxInt64-2 {
+			t.Errorf("Bad counter value %d: %v", n, err)
+		}
+	})
+
+	t.Run("ttl", func(t *testing.T) {
+		if err := db.PutWithTTL("session", "1", time.Minute); err != nil {
+			t.Fatal(err)
+		}
+		if n, err := db.Increment("session", 1); err != nil || n != 2 {
+			t.Errorf("Bad counter value %d: %v", n, err)
+		}
+
+		defer func() { now = time.Now }()
+		now = func() time.Time { return time.Now().Add(time.Hour) }
+		if _, err := db.Get("session"); err != ErrNotFound {
+			t.Errorf("Incremented value doesn't expire: %v", err)
+		}
+		// the expired value is taken as missing
+		if n, err := db.Increment("session", 1); err != nil || n != 1 {
+			t.Errorf("Bad counter value %d: %v", n, err)
+		}
+	})
+
+	t.Run("bucket", func(t *testing.T) {
+		b, err := db.CreateBucket("counters")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n, err := b.Increment("counter", 5); err != nil || n != 5 {
+			t.Errorf("Bad counter value %d: %v", n, err)
+		}
+		if err := db.DropBucket("counters"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := b.Increment("counter", 5); err != ErrBucketNotFound {
+			t.Errorf("Expected %v, got %v", ErrBucketNotFound, err)
+		}
+	})
+}
+
+func TestDb_ApplySnapshot(t *testing.T) {
+	open := func() *Db {
+		dir, err := ioutil.TempDir("", "test-db")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { os.RemoveAll(dir) })
+		db, err := NewDb(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { db.Close() })
+		return db
+	}
+
+	// the keys are compared a few at a time, so the stale ones are found in every chunk
+	defer func(size int) { snapshotChunkSize = size }(snapshotChunkSize)
+	snapshotChunkSize = 3
+
+	leader, follower := open(), open()
+	var expected []string
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("key%02d", i)
+		if err := leader.Put(key, "value"); err != nil {
+			t.Fatal(err)
+		}
+		expected = append(expected, key)
+	}
+	for _, key := range []string{"a", "key00", "key05x", "key10", "key13x", "key19x", "z"} {
+		if err := follower.Put(key, "stale"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	snapshot, err := leader.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snapshot.Close()
+	var buf bytes.Buffer
+	if _, err := snapshot.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := follower.ApplySnapshot(&buf, snapshot.Version); err != nil {
+		t.Fatal(err)
+	}
+
+	if keys, err := follower.Scan("", "", 0); err != nil || !reflect.DeepEqual(keys, expected) {
+		t.Errorf("Unexpected keys %v: %v", keys, err)
+	}
+	if value, err := follower.Get("key10"); err != nil || value != "value" {
+		t.Errorf("Bad value of key10: %s, %v", value, err)
+	}
+}
+
+func BenchmarkDb_PutSyncAlways(b *testing.B) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := DefaultOptions()
+	opts.Durability = SyncAlways
+	db, err := NewDbWithOptions(dir, opts)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+
+	b.SetParallelism(16)
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			i++
+			if err := db.Put(fmt.Sprintf("key%d", i), "value"); err != nil {
+				b.Error(err)
+			}
+		}
+	})
+}
+
+func BenchmarkDb_Get(b *testing.B) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDbSizedMerge(dir, 64*1024, false)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+
+	const keys = 10000
+	for i := 0; i < keys; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i)); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.Run("sequential", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := db.Get(fmt.Sprintf("key%d", i%keys)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("parallel", func(b *testing.B) {
+		b.RunParallel(func(pb *testing.PB) {
+			i := 0
+			for pb.Next() {
+				i++
+				if _, err := db.Get(fmt.Sprintf("key%d", i%keys)); err != nil {
+					b.Error(err)
+				}
+			}
+		})
+	})
+}
@@ -3,48 +3,102 @@ package datastore
 import (
 	"bufio"
 	"encoding/binary"
-	"fmt"
+	"hash/crc32"
+	"io"
 )
 
+// every record starts with its size and ends with crc32 checksum of all the preceding bytes:
+// size | key size | key | value size | value | expiration time | version | crc32.
+// The highest bit of the value size tells that the value is encrypted
+const checksumSize = 4
+const metaSize = 16
+const minRecordSize = 12 + metaSize + checksumSize
+
 type entry struct {
 	key, value string
+	deleted    bool
+	// unix time in nanoseconds after which the entry is treated as deleted, zero means it never expires
+	expiresAt int64
+	// every write gets the next version of the database, so the latest record of a key has the biggest one
+	version uint64
+	// encrypted value holds the sealed payload until the keyring decrypts it
+	encrypted bool
+}
+
+func (e *entry) expired() bool {
+	return e.expiresAt != 0 && e.expiresAt <= now().UnixNano()
+}
+
+func (e *entry) encode() []byte {
+	if e.deleted {
+		return e.EncodeDeleted()
+	}
+	return e.Encode()
 }
 
 func (e *entry) Encode() []byte {
 	kl := len(e.key)
 	vl := len(e.value)
-	size := kl + vl + 12
+	size := kl + vl + 12 + metaSize + checksumSize
 	res := make([]byte, size)
 	binary.LittleEndian.PutUint32(res, uint32(size))
 	binary.LittleEndian.PutUint32(res[4:], uint32(kl))
 	copy(res[8:], e.key)
-	binary.LittleEndian.PutUint32(res[kl+8:], uint32(vl))
+	if e.encrypted {
+		binary.LittleEndian.PutUint32(res[kl+8:], uint32(vl)|encryptedValueFlag)
+	} else {
+		binary.LittleEndian.PutUint32(res[kl+8:], uint32(vl))
+	}
 	copy(res[kl+12:], e.value)
+	e.putMeta(res[kl+vl+12:])
+	putChecksum(res)
 	return res
 }
 
 func (e *entry) EncodeDeleted() []byte {
 	kl := len(e.key)
 	vl := deletedValueLength
-	size := kl + 12
+	size := kl + 12 + metaSize + checksumSize
 	res := make([]byte, size)
 	binary.LittleEndian.PutUint32(res, uint32(size))
 	binary.LittleEndian.PutUint32(res[4:], uint32(kl))
 	copy(res[8:], e.key)
 	binary.LittleEndian.PutUint32(res[kl+8:], uint32(vl))
+	e.putMeta(res[kl+12:])
+	putChecksum(res)
 	return res
 }
 
 func (e *entry) Decode(input []byte) error {
+	if !validChecksum(input) {
+		return ErrCorrupted
+	}
+	body := len(input) - checksumSize
+
 	kl := binary.LittleEndian.Uint32(input[4:])
+	if int64(kl)+12+metaSize > int64(body) {
+		return ErrCorrupted
+	}
 	keyBuf := make([]byte, kl)
 	copy(keyBuf, input[8:kl+8])
 	e.key = string(keyBuf)
 
 	vl := binary.LittleEndian.Uint32(input[kl+8:])
 	if int32(vl) == deletedValueLength {
+		vl = 0
+	} else if vl&encryptedValueFlag != 0 {
+		vl &^= encryptedValueFlag
+		e.encrypted = true
+	}
+	if int64(kl)+12+int64(vl)+metaSize != int64(body) {
+		return ErrCorrupted
+	}
+	e.expiresAt = int64(binary.LittleEndian.Uint64(input[kl+12+vl:]))
+	e.version = binary.LittleEndian.Uint64(input[kl+12+vl+8:])
+	if int32(binary.LittleEndian.Uint32(input[kl+8:])) == deletedValueLength {
 		return ErrItemDeleted
 	}
+
 	valBuf := make([]byte, vl)
 	copy(valBuf, input[kl+12:kl+12+vl])
 	e.value = string(valBuf)
@@ -52,40 +106,105 @@ func (e *entry) Decode(input []byte) error {
 	return nil
 }
 
-func readValue(in *bufio.Reader) (string, error) {
-	header, err := in.Peek(8)
+func (e *entry) putMeta(res []byte) {
+	binary.LittleEndian.PutUint64(res, uint64(e.expiresAt))
+	binary.LittleEndian.PutUint64(res[8:], e.version)
+}
+
+func putChecksum(record []byte) {
+	body := len(record) - checksumSize
+	binary.LittleEndian.PutUint32(record[body:], crc32.ChecksumIEEE(record[:body]))
+}
+
+func validChecksum(record []byte) bool {
+	if len(record) < minRecordSize || binary.LittleEndian.Uint32(record) != uint32(len(record)) {
+		return false
+	}
+	body := len(record) - checksumSize
+	return binary.LittleEndian.Uint32(record[body:]) == crc32.ChecksumIEEE(record[:body])
+}
+
+// readRecord reads the whole next record of the format version from the input, maxSize limits the size the record
+// header may declare. io.EOF is returned only when there are no bytes left, a partially written record is reported
+// as ErrCorrupted
+func readRecord(in *bufio.Reader, maxSize int64, version uint32) ([]byte, error) {
+	header, err := in.Peek(4)
+	if err == io.EOF && len(header) == 0 {
+		return nil, io.EOF
+	}
+	if err == io.EOF {
+		return nil, ErrCorrupted
+	}
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+
+	size := int64(binary.LittleEndian.Uint32(header))
+	if size < minRecordSizeOf(version) || size > maxSize {
+		return nil, ErrCorrupted
+	}
+
+	data := make([]byte, size)
+	_, err = io.ReadFull(in, data)
+	if err == io.ErrUnexpectedEOF || err == io.EOF {
+		return nil, ErrCorrupted
 	}
-	keySize := int(binary.LittleEndian.Uint32(header[4:]))
-	_, err = in.Discard(keySize + 8)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
+	return data, nil
+}
 
-	header, err = in.Peek(4)
+func readEntry(in *bufio.Reader) (*entry, error) {
+	data, err := readRecord(in, maxRecordSize, FormatVersion)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+
+	var e entry
+	if err := e.Decode(data); err != nil {
+		return nil, err
 	}
+	return &e, nil
+}
 
-	valSize := int32(binary.LittleEndian.Uint32(header))
-	if valSize == deletedValueLength {
-		return "", ErrItemDeleted
+// readEntryAt reads the entry at the position without moving any file offset, so it may be called concurrently
+func readEntryAt(in io.ReaderAt, position int64, version uint32) (*entry, error) {
+	var header [4]byte
+	if _, err := in.ReadAt(header[:], position); err != nil {
+		if err == io.EOF {
+			return nil, ErrCorrupted
+		}
+		return nil, err
 	}
 
-	_, err = in.Discard(4)
+	size := binary.LittleEndian.Uint32(header[:])
+	if int64(size) < minRecordSizeOf(version) {
+		return nil, ErrCorrupted
+	}
+	data := make([]byte, size)
+	if _, err := in.ReadAt(data, position); err != nil {
+		if err == io.EOF {
+			return nil, ErrCorrupted
+		}
+		return nil, err
+	}
+	data, err := upgradeRecord(data, version)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	data := make([]byte, valSize)
-	n, err := in.Read(data)
+	var e entry
+	if err := e.Decode(data); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+func readValue(in *bufio.Reader) (string, error) {
+	e, err := readEntry(in)
 	if err != nil {
 		return "", err
 	}
-	if n != int(valSize) {
-		return "", fmt.Errorf("can't read value bytes (read %d, expected %d)", n, valSize)
-	}
-
-	return string(data), nil
+	return e.value, nil
 }
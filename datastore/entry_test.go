@@ -7,7 +7,7 @@ import (
 )
 
 func TestEntry_Encode(t *testing.T) {
-	e := entry{"key", "value"}
+	e := entry{key: "key", value: "value"}
 	e.Decode(e.Encode())
 	if e.key != "key" {
 		t.Error("incorrect key")
@@ -18,7 +18,7 @@ func TestEntry_Encode(t *testing.T) {
 }
 
 func TestReadValue(t *testing.T) {
-	e := entry{"key", "test-value"}
+	e := entry{key: "key", value: "test-value"}
 	data := e.Encode()
 	v, err := readValue(bufio.NewReader(bytes.NewReader(data)))
 	if err != nil {
@@ -34,3 +34,24 @@ func TestReadValue(t *testing.T) {
 		t.Fatal("item should be deleted")
 	}
 }
+
+func TestEntry_Checksum(t *testing.T) {
+	e := entry{key: "key", value: "value"}
+	data := e.Encode()
+	data[9] ^= 0xff
+
+	var decoded entry
+	if err := decoded.Decode(data); err != ErrCorrupted {
+		t.Errorf("Damaged record decoded without error: %v", err)
+	}
+
+	_, err := readValue(bufio.NewReader(bytes.NewReader(data)))
+	if err != ErrCorrupted {
+		t.Errorf("Damaged value read without error: %v", err)
+	}
+
+	_, err = readValue(bufio.NewReader(bytes.NewReader(e.Encode()[:10])))
+	if err != ErrCorrupted {
+		t.Errorf("Torn record read without error: %v", err)
+	}
+}
@@ -0,0 +1,18 @@
+//go:build !windows
+// +build !windows
+
+package datastore
+
+import (
+	"os"
+	"syscall"
+)
+
+// dupFile returns the new handle of the open file, it stays valid after the original one is closed
+func dupFile(f *os.File) (*os.File, error) {
+	fd, err := syscall.Dup(int(f.Fd()))
+	if err != nil {
+		return nil, err
+	}
+	return os.NewFile(uintptr(fd), f.Name()), nil
+}
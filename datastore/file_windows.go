@@ -0,0 +1,23 @@
+//go:build windows
+// +build windows
+
+package datastore
+
+import (
+	"os"
+	"syscall"
+)
+
+// dupFile returns the new handle of the open file, it stays valid after the original one is closed
+func dupFile(f *os.File) (*os.File, error) {
+	process, err := syscall.GetCurrentProcess()
+	if err != nil {
+		return nil, err
+	}
+	var h syscall.Handle
+	err = syscall.DuplicateHandle(process, syscall.Handle(f.Fd()), process, &h, 0, false, syscall.DUPLICATE_SAME_ACCESS)
+	if err != nil {
+		return nil, err
+	}
+	return os.NewFile(uintptr(h), f.Name()), nil
+}
@@ -0,0 +1,345 @@
+package datastore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+// segment file starts with the header: zero | magic | format version. No record has zero size, so the segments
+// written before the header was introduced, which start right with a record, are told by their first record:
+// the baseline ones have neither metadata nor checksum, the legacy ones have both
+const segmentHeaderSize = 12
+const segmentMagic = 0x4b564753
+
+// FormatVersion is the version of the segments written by the database, the older ones are still read,
+// their records are upgraded as they are read, and Upgrade rewrites them in the current format
+const FormatVersion = 2
+const baselineFormat = 0
+const legacyFormat = 1
+
+// baseline record is size | key size | key | value size | value, the value size of a tombstone is -1
+const baselineMinRecordSize = 12
+
+// upgrades convert a record of the version to the next one; every version but the current one must have it.
+// A batch record has to keep the positions of its inner records, since the index points to them
+var upgrades = map[uint32]func(record []byte) ([]byte, error){
+	baselineFormat: upgradeBaselineRecord,
+	// legacy records are the same as the current ones, only the header is new
+	legacyFormat: func(record []byte) ([]byte, error) {
+		return record, nil
+	},
+}
+
+// baseline records get the first version, zero is the version of the missing key for CompareAndSwap
+const baselineVersion = 1
+
+// upgradeBaselineRecord adds the metadata and the checksum to the baseline record. Baseline records have
+// neither expiration time nor version, so they never expire and all of them get baselineVersion
+func upgradeBaselineRecord(record []byte) ([]byte, error) {
+	if len(record) < baselineMinRecordSize || binary.LittleEndian.Uint32(record) != uint32(len(record)) {
+		return nil, ErrCorrupted
+	}
+	kl := int64(binary.LittleEndian.Uint32(record[4:]))
+	if kl+baselineMinRecordSize > int64(len(record)) {
+		return nil, ErrCorrupted
+	}
+	e := entry{key: string(record[8 : kl+8]), version: baselineVersion}
+	vl := int64(int32(binary.LittleEndian.Uint32(record[kl+8:])))
+	switch {
+	case vl == deletedValueLength && kl+baselineMinRecordSize == int64(len(record)):
+		e.deleted = true
+	case vl >= 0 && kl+baselineMinRecordSize+vl == int64(len(record)):
+		e.value = string(record[kl+12:])
+	default:
+		return nil, ErrCorrupted
+	}
+	return e.encode(), nil
+}
+
+// minRecordSizeOf returns the size of the smallest record of the format version
+func minRecordSizeOf(version uint32) int64 {
+	if version == baselineFormat {
+		return baselineMinRecordSize
+	}
+	return minRecordSize
+}
+
+// merge drops the records of the deleted keys, so the header of the merged segment is followed by the marker keeping
+// the biggest version of the merged ones, which is read with the header even when there is no hint. The marker is
+// a tombstone of the key no bucket or user key can have, and it's skipped like the header by everything reading records
+const versionMarkerKey = bucketRegistryPrefix
+
+func versionMarker(version uint64) []byte {
+	e := entry{key: versionMarkerKey, deleted: true, version: version}
+	return e.encode()
+}
+
+func segmentHeader() []byte {
+	header := make([]byte, segmentHeaderSize)
+	binary.LittleEndian.PutUint32(header[4:], segmentMagic)
+	binary.LittleEndian.PutUint32(header[8:], FormatVersion)
+	return header
+}
+
+// writeHeader starts the new segment file
+func (s *segment) writeHeader(out io.Writer) error {
+	if _, err := out.Write(segmentHeader()); err != nil {
+		return err
+	}
+	s.version = FormatVersion
+	s.headerless = false
+	s.markerSize = 0
+	s.offset = segmentHeaderSize
+	return nil
+}
+
+// writeMarker follows the header of the merged segment with the version marker
+func (s *segment) writeMarker(out io.Writer, version uint64) error {
+	marker := versionMarker(version)
+	if _, err := out.Write(marker); err != nil {
+		return err
+	}
+	s.markerSize = int64(len(marker))
+	s.offset += s.markerSize
+	if version > s.maxVersion {
+		s.maxVersion = version
+	}
+	return nil
+}
+
+// headerSize is the size of the segment file taken by the header and the version marker
+func (s *segment) headerSize() int64 {
+	if s.headerless {
+		return 0
+	}
+	return segmentHeaderSize + s.markerSize
+}
+
+// readFormat reads the header of the segment file and moves s.offset to the first record. An empty file is
+// taken as the current format, the header is written before the first record
+func (s *segment) readFormat(in io.ReaderAt, fileSize int64) error {
+	s.version = FormatVersion
+	s.headerless = false
+	s.markerSize = 0
+	s.offset = 0
+	if fileSize == 0 {
+		return nil
+	}
+
+	var header [segmentHeaderSize]byte
+	n, err := in.ReadAt(header[:], 0)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if n < 4 || binary.LittleEndian.Uint32(header[:]) != 0 {
+		s.headerless = true
+		s.version, err = headerlessFormat(in, fileSize)
+		return err
+	}
+	if n < segmentHeaderSize || binary.LittleEndian.Uint32(header[4:]) != segmentMagic {
+		return ErrCorrupted
+	}
+
+	version := binary.LittleEndian.Uint32(header[8:])
+	if version > FormatVersion {
+		return fmt.Errorf("%s has format version %d, the latest supported one is %d", s.path, version, FormatVersion)
+	}
+	if version != FormatVersion && upgrades[version] == nil {
+		return fmt.Errorf("%s has format version %d, which can't be upgraded", s.path, version)
+	}
+	s.version = version
+	s.offset = segmentHeaderSize
+	if version == FormatVersion {
+		return s.readMarker(in, fileSize)
+	}
+	return nil
+}
+
+// readMarker moves s.offset past the version marker if the segment has one
+func (s *segment) readMarker(in io.ReaderAt, fileSize int64) error {
+	size := int64(len(versionMarker(0)))
+	if fileSize-s.offset < size {
+		return nil
+	}
+	record := make([]byte, size)
+	if _, err := in.ReadAt(record, s.offset); err != nil {
+		return err
+	}
+	var e entry
+	if e.Decode(record) != ErrItemDeleted || e.key != versionMarkerKey {
+		return nil
+	}
+	s.markerSize = size
+	s.offset += size
+	if e.version > s.maxVersion {
+		s.maxVersion = e.version
+	}
+	return nil
+}
+
+// headerlessFormat tells the baseline segment from the legacy one by its first record. The size of a legacy record
+// includes the metadata and the checksum, so it never matches the key and value sizes the way a baseline one does.
+// A damaged first record is taken as the legacy one and is reported by recover
+func headerlessFormat(in io.ReaderAt, fileSize int64) (uint32, error) {
+	var header [4]byte
+	if _, err := in.ReadAt(header[:], 0); err != nil && err != io.EOF {
+		return 0, err
+	}
+	size := int64(binary.LittleEndian.Uint32(header[:]))
+	if size < baselineMinRecordSize || size > fileSize {
+		return legacyFormat, nil
+	}
+	record := make([]byte, size)
+	if _, err := in.ReadAt(record, 0); err != nil && err != io.EOF {
+		return 0, err
+	}
+	if validChecksum(record) {
+		return legacyFormat, nil
+	}
+	if _, err := upgradeBaselineRecord(record); err == nil {
+		return baselineFormat, nil
+	}
+	return legacyFormat, nil
+}
+
+// loadFormat reads the header of the sealed segment, which is loaded from its hint. It's read through the reader
+// of the segment, so the index loaded afterwards points into the same file even if the path is taken meanwhile
+func (s *segment) loadFormat() error {
+	f, err := s.readFile()
+	if err != nil {
+		return err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return s.readFormat(f, fi.Size())
+}
+
+// upgradeRecord converts the record of the segment format version to the current one
+func upgradeRecord(record []byte, version uint32) ([]byte, error) {
+	for ; version < FormatVersion; version++ {
+		var err error
+		if record, err = upgrades[version](record); err != nil {
+			return nil, err
+		}
+	}
+	return record, nil
+}
+
+// SegmentFormat returns the format version of the segment file
+func SegmentFormat(path string) (uint32, error) {
+	s := newSegment(path)
+	defer s.close()
+	if err := s.loadFormat(); err != nil {
+		return 0, err
+	}
+	return s.version, nil
+}
+
+// Upgrade rewrites the segments of the closed database in dir which have an older format and returns their paths.
+// Corrupted records stop the upgrade, they have to be truncated first
+func Upgrade(dir string) ([]string, error) {
+	lock, err := lockDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.release()
+
+	paths, err := SegmentFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	var upgraded []string
+	for _, path := range paths {
+		ok, err := upgradeSegment(path)
+		if err != nil {
+			return upgraded, fmt.Errorf("cannot upgrade %s: %w", path, err)
+		}
+		if ok {
+			upgraded = append(upgraded, path)
+		}
+	}
+	return upgraded, nil
+}
+
+func upgradeSegment(path string) (bool, error) {
+	input, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer input.Close()
+
+	fi, err := input.Stat()
+	if err != nil {
+		return false, err
+	}
+	// the hint is checked against the open file
+	s := newSegment(path)
+	s.reader = input
+	if err := s.readFormat(input, fi.Size()); err != nil {
+		return false, err
+	}
+	if s.version == FormatVersion && fi.Size() > 0 {
+		return false, nil
+	}
+
+	tmpPath := path + ".upgrade"
+	out, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return false, err
+	}
+	w := bufio.NewWriterSize(out, bufSize)
+	w.Write(segmentHeader())
+	// the segment merged before the marker was introduced keeps the version of its dropped records only in the hint,
+	// which is removed below
+	if footer, err := s.readHint(func(indexEntry, int64) {}); err == nil && footer.maxVersion > 0 {
+		w.Write(versionMarker(footer.maxVersion))
+	}
+
+	in := bufio.NewReaderSize(io.NewSectionReader(input, s.offset, fi.Size()-s.offset), bufSize)
+	for {
+		record, err := readRecord(in, fi.Size()-s.offset, s.version)
+		if err == io.EOF {
+			break
+		}
+		var data []byte
+		if err == nil {
+			data, err = upgradeRecord(record, s.version)
+		}
+		if err == nil {
+			_, _, err = decodeRecord(data)
+		}
+		if err != nil {
+			out.Close()
+			os.Remove(tmpPath)
+			return false, fmt.Errorf("record at offset %d: %w", s.offset, err)
+		}
+		w.Write(data)
+		// the upgraded record may be longer than the original one
+		s.offset += int64(len(record))
+	}
+
+	err = w.Flush()
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return false, err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return false, err
+	}
+	// positions of the records have moved, so the hint and the bloom filter are built again on open
+	s.removeHint()
+	s.removeFilter()
+	return true, nil
+}
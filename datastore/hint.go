@@ -0,0 +1,275 @@
+package datastore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+)
+
+// hint file stores the index of a sealed segment, so it can be loaded without reading the whole segment. Entries
+// are sorted by key, so the file also serves as the on-disk index of the segment, and the footer goes last,
+// so the file can be written while the segment is being merged:
+// entries (key size | key | position | expiration time) |
+// segment size | segment modification time | max version | records count | index entries count | crc32
+const hintSuffix = ".hint"
+const hintFooterSize = 36
+
+var errStaleHint = fmt.Errorf("hint file does not match the segment")
+
+type hintFooter struct {
+	size       int64
+	modTime    int64
+	maxVersion uint64
+	records    int
+	count      int
+}
+
+func (s *segment) hintPath() string {
+	return s.path + hintSuffix
+}
+
+// hintWriter writes the hint entries as they come, they have to be added in the key order
+type hintWriter struct {
+	path    string
+	f       *os.File
+	hash    hash.Hash32
+	out     *bufio.Writer
+	offset  int64
+	count   int
+	samples []indexSample
+	lastKey string
+}
+
+func newHintWriter(path string) (*hintWriter, error) {
+	f, err := os.OpenFile(path+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	w := &hintWriter{path: path, f: f, hash: crc32.NewIEEE()}
+	w.out = bufio.NewWriterSize(io.MultiWriter(f, w.hash), bufSize)
+	return w, nil
+}
+
+func (w *hintWriter) add(e indexEntry) error {
+	if w.count > 0 && e.key <= w.lastKey {
+		return fmt.Errorf("hint entries are not sorted: %s after %s", e.key, w.lastKey)
+	}
+	if w.count%indexSampleInterval == 0 {
+		w.samples = append(w.samples, indexSample{key: e.key, offset: w.offset})
+	}
+	w.lastKey = e.key
+	w.count++
+
+	var buf [8]byte
+	binary.LittleEndian.PutUint32(buf[:], uint32(len(e.key)))
+	w.out.Write(buf[:4])
+	w.out.WriteString(e.key)
+	binary.LittleEndian.PutUint64(buf[:], uint64(e.position))
+	w.out.Write(buf[:])
+	binary.LittleEndian.PutUint64(buf[:], uint64(e.expiresAt))
+	_, err := w.out.Write(buf[:])
+	w.offset += int64(len(e.key)) + 20
+	return err
+}
+
+// finish writes the footer for the segment file and moves the hint in place
+func (w *hintWriter) finish(segmentPath string, maxVersion uint64, records int) error {
+	fi, err := os.Stat(segmentPath)
+	if err != nil {
+		w.abort()
+		return err
+	}
+
+	var footer [hintFooterSize - 4]byte
+	binary.LittleEndian.PutUint64(footer[:], uint64(fi.Size()))
+	binary.LittleEndian.PutUint64(footer[8:], uint64(fi.ModTime().UnixNano()))
+	binary.LittleEndian.PutUint64(footer[16:], maxVersion)
+	binary.LittleEndian.PutUint32(footer[24:], uint32(records))
+	binary.LittleEndian.PutUint32(footer[28:], uint32(w.count))
+	w.out.Write(footer[:])
+
+	err = w.out.Flush()
+	if err == nil {
+		var buf [4]byte
+		binary.LittleEndian.PutUint32(buf[:], w.hash.Sum32())
+		_, err = w.f.Write(buf[:])
+	}
+	if closeErr := w.f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(w.path + ".tmp")
+		return err
+	}
+	return os.Rename(w.path+".tmp", w.path)
+}
+
+func (w *hintWriter) abort() {
+	w.f.Close()
+	os.Remove(w.path + ".tmp")
+}
+
+// writeHint saves the in-memory index of the segment
+func (s *segment) writeHint() error {
+	_, err := s.writeHintFile()
+	return err
+}
+
+func (s *segment) writeHintFile() (*hintWriter, error) {
+	w, err := newHintWriter(s.hintPath())
+	if err != nil {
+		return nil, err
+	}
+
+	for n := s.keys.head.next[0]; n != nil; n = n.next[0] {
+		key := n.key
+		if err := w.add(indexEntry{key: key, position: s.index[key], expiresAt: s.expiry[key]}); err != nil {
+			w.abort()
+			return nil, err
+		}
+	}
+	return w, w.finish(s.path, s.maxVersion, s.records)
+}
+
+// readHint checks the hint of the segment and passes all its entries to visit with their offsets in the file
+func (s *segment) readHint(visit func(e indexEntry, offset int64)) (hintFooter, error) {
+	f, err := os.Open(s.hintPath())
+	if err != nil {
+		return hintFooter{}, err
+	}
+	defer f.Close()
+	return s.readHintFile(f, visit)
+}
+
+// readHintFile checks the open hint against the file the segment is read through, which is the one the positions
+// of the entries have to point into
+func (s *segment) readHintFile(f *os.File, visit func(e indexEntry, offset int64)) (hintFooter, error) {
+	var footer hintFooter
+	in, err := s.readFile()
+	if err != nil {
+		return footer, err
+	}
+	fi, err := in.Stat()
+	if err != nil {
+		return footer, err
+	}
+
+	hfi, err := f.Stat()
+	if err != nil {
+		return footer, err
+	}
+	entriesEnd := hfi.Size() - hintFooterSize
+	if entriesEnd < 0 {
+		return footer, errStaleHint
+	}
+
+	var buf [hintFooterSize]byte
+	if _, err := f.ReadAt(buf[:], entriesEnd); err != nil {
+		return footer, errStaleHint
+	}
+	footer = hintFooter{
+		size:       int64(binary.LittleEndian.Uint64(buf[:])),
+		modTime:    int64(binary.LittleEndian.Uint64(buf[8:])),
+		maxVersion: binary.LittleEndian.Uint64(buf[16:]),
+		records:    int(binary.LittleEndian.Uint32(buf[24:])),
+		count:      int(binary.LittleEndian.Uint32(buf[28:])),
+	}
+	if footer.size != fi.Size() || footer.modTime != fi.ModTime().UnixNano() {
+		return footer, errStaleHint
+	}
+
+	hash := crc32.NewIEEE()
+	entries := newHintReader(io.TeeReader(bufio.NewReaderSize(io.NewSectionReader(f, 0, entriesEnd), bufSize), hash), entriesEnd)
+	var prev string
+	for i := 0; i < footer.count; i++ {
+		offset := entries.offset
+		e, err := entries.next()
+		if err != nil || (i > 0 && e.key <= prev) {
+			return footer, errStaleHint
+		}
+		prev = e.key
+		visit(e, offset)
+	}
+	if entries.offset != entriesEnd {
+		return footer, errStaleHint
+	}
+
+	hash.Write(buf[:hintFooterSize-4])
+	if binary.LittleEndian.Uint32(buf[hintFooterSize-4:]) != hash.Sum32() {
+		return footer, errStaleHint
+	}
+	return footer, nil
+}
+
+// loadHint fills the in-memory index of the segment from its hint
+func (s *segment) loadHint() error {
+	index := make(hashIndex)
+	expiry := make(map[string]int64)
+	var keys []string
+	footer, err := s.readHint(func(e indexEntry, offset int64) {
+		index[e.key] = e.position
+		keys = append(keys, e.key)
+		if e.expiresAt != 0 {
+			expiry[e.key] = e.expiresAt
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	// the hint keeps the keys sorted
+	s.index = index
+	s.keys = newKeyList(keys)
+	s.expiry = expiry
+	s.maxVersion = footer.maxVersion
+	s.records = footer.records
+	s.offset = footer.size
+	return nil
+}
+
+// hintReader reads the hint entries one by one
+type hintReader struct {
+	in     io.Reader
+	end    int64
+	offset int64
+}
+
+func newHintReader(in io.Reader, end int64) *hintReader {
+	return &hintReader{in: in, end: end}
+}
+
+func (r *hintReader) next() (indexEntry, error) {
+	var buf [8]byte
+	if _, err := io.ReadFull(r.in, buf[:4]); err != nil {
+		return indexEntry{}, err
+	}
+	kl := int64(binary.LittleEndian.Uint32(buf[:]))
+	if r.offset+kl+20 > r.end {
+		return indexEntry{}, errStaleHint
+	}
+	key := make([]byte, kl)
+	if _, err := io.ReadFull(r.in, key); err != nil {
+		return indexEntry{}, err
+	}
+	if _, err := io.ReadFull(r.in, buf[:]); err != nil {
+		return indexEntry{}, err
+	}
+	position := int64(binary.LittleEndian.Uint64(buf[:]))
+	if _, err := io.ReadFull(r.in, buf[:]); err != nil {
+		return indexEntry{}, err
+	}
+	r.offset += kl + 20
+	return indexEntry{key: string(key), position: position, expiresAt: int64(binary.LittleEndian.Uint64(buf[:]))}, nil
+}
+
+func (s *segment) removeHint() {
+	err := os.Remove(s.hintPath())
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("cannot remove hint file: %v", err)
+	}
+}
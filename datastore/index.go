@@ -0,0 +1,333 @@
+package datastore
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"sort"
+)
+
+// IndexMode defines where the indexes of sealed segments are kept
+type IndexMode int
+
+const (
+	// IndexInMemory keeps every key of every segment in memory
+	IndexInMemory IndexMode = iota
+	// IndexOnDisk keeps the indexes of sealed segments in their sorted hint files with only every
+	// indexSampleInterval-th key in memory, so the database may hold more keys than fit in memory;
+	// a lookup in a sealed segment costs an extra disk read
+	IndexOnDisk
+)
+
+const indexSampleInterval = 64
+
+type indexEntry struct {
+	key       string
+	position  int64
+	expiresAt int64
+}
+
+// alive tells whether the entry points to a value which is not deleted or expired
+func (e indexEntry) alive(now int64) bool {
+	return e.position != deletedItemPos && (e.expiresAt == 0 || e.expiresAt > now)
+}
+
+type indexSample struct {
+	key    string
+	offset int64
+}
+
+// diskIndex finds keys in the sorted hint file: the sample tells which block of entries may contain the key,
+// and only that block is read. The hint is kept open like the segment file, so it's read even after a writer
+// of the read-only database merges the segment away
+type diskIndex struct {
+	file       *os.File
+	samples    []indexSample
+	count      int
+	entriesEnd int64
+}
+
+func openDiskIndex(path string, samples []indexSample, count int, entriesEnd int64) (*diskIndex, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &diskIndex{file: f, samples: samples, count: count, entriesEnd: entriesEnd}, nil
+}
+
+// loadDiskIndex checks the hint of the segment and keeps its sample instead of the in-memory index
+func (s *segment) loadDiskIndex() error {
+	f, err := os.Open(s.hintPath())
+	if err != nil {
+		return err
+	}
+	var (
+		samples []indexSample
+		i       int
+		end     int64
+	)
+	footer, err := s.readHintFile(f, func(e indexEntry, offset int64) {
+		if i%indexSampleInterval == 0 {
+			samples = append(samples, indexSample{key: e.key, offset: offset})
+		}
+		i++
+		end = offset + int64(len(e.key)) + 20
+	})
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	// the checked hint is kept open instead of opening it by path again
+	s.useDiskIndex(&diskIndex{file: f, samples: samples, count: footer.count, entriesEnd: end})
+	s.maxVersion = footer.maxVersion
+	s.records = footer.records
+	s.offset = footer.size
+	return nil
+}
+
+// saveIndex writes the hint of the sealed segment, with the disk index the hint replaces the in-memory index
+func (s *segment) saveIndex(mode IndexMode) error {
+	w, err := s.writeHintFile()
+	if err != nil || mode != IndexOnDisk {
+		return err
+	}
+	disk, err := openDiskIndex(s.hintPath(), w.samples, w.count, w.offset)
+	if err != nil {
+		return err
+	}
+	s.useDiskIndex(disk)
+	return nil
+}
+
+// useDiskIndex replaces the in-memory index of the sealed segment
+func (s *segment) useDiskIndex(disk *diskIndex) {
+	s.disk = disk
+	s.index = nil
+	s.keys = nil
+	s.expiry = nil
+}
+
+func (d *diskIndex) lookup(key string) (indexEntry, bool, error) {
+	// the block of the last sample which is not bigger than the key
+	i := sort.Search(len(d.samples), func(i int) bool { return d.samples[i].key > key }) - 1
+	if i < 0 {
+		return indexEntry{}, false, nil
+	}
+	end := d.entriesEnd
+	if i+1 < len(d.samples) {
+		end = d.samples[i+1].offset
+	}
+
+	block := make([]byte, end-d.samples[i].offset)
+	if _, err := d.file.ReadAt(block, d.samples[i].offset); err != nil {
+		return indexEntry{}, false, err
+	}
+	in := newHintReader(bytes.NewReader(block), int64(len(block)))
+	for in.offset < int64(len(block)) {
+		e, err := in.next()
+		if err != nil {
+			return indexEntry{}, false, err
+		}
+		if e.key == key {
+			return e, true, nil
+		}
+		if e.key > key {
+			break
+		}
+	}
+	return indexEntry{}, false, nil
+}
+
+func (d *diskIndex) close() error {
+	return d.file.Close()
+}
+
+// lookup finds the key in the index of the segment
+func (s *segment) lookup(key string) (indexEntry, bool, error) {
+	if s.disk != nil {
+		return s.disk.lookup(key)
+	}
+	position, ok := s.index[key]
+	if !ok {
+		return indexEntry{}, false, nil
+	}
+	return indexEntry{key: key, position: position, expiresAt: s.expiry[key]}, true, nil
+}
+
+func (s *segment) keyCount() int {
+	if s.disk != nil {
+		return s.disk.count
+	}
+	return len(s.index)
+}
+
+// indexCursor walks the index of a segment in the key order
+type indexCursor interface {
+	next() (indexEntry, bool, error)
+	close() error
+}
+
+// cursor has to be created under the database lock: the in-memory index is copied and the hint file is opened,
+// so the cursor may be used after the lock is released, even if the segment is merged meanwhile
+func (s *segment) cursor() (indexCursor, error) {
+	c, _, err := s.rangeCursor("", "", 0)
+	return c, err
+}
+
+// rangeCursor is the cursor which starts at the first key not less than start and stops before end, empty end
+// means no bound. At most limit keys are copied from the in-memory index, zero means no limit; cut tells that
+// the limit has left some keys of the range out. The disk cursor doesn't copy anything, so it's never cut
+func (s *segment) rangeCursor(start, end string, limit int) (c indexCursor, cut bool, err error) {
+	if s.disk != nil {
+		from := int64(0)
+		// the block of the last sample which is not bigger than start
+		if i := sort.Search(len(s.disk.samples), func(i int) bool { return s.disk.samples[i].key > start }) - 1; i >= 0 {
+			from = s.disk.samples[i].offset
+		}
+		f, err := dupFile(s.disk.file)
+		if err != nil {
+			return nil, false, err
+		}
+		in := bufio.NewReaderSize(io.NewSectionReader(f, from, s.disk.entriesEnd-from), bufSize)
+		return &diskCursor{f: f, in: newHintReader(in, s.disk.entriesEnd-from)}, false, nil
+	}
+
+	var entries []indexEntry
+	for n := s.keys.seek(start, nil); n != nil; n = n.next[0] {
+		key := n.key
+		if end != "" && key >= end {
+			break
+		}
+		if limit > 0 && len(entries) == limit {
+			cut = true
+			break
+		}
+		entries = append(entries, indexEntry{key: key, position: s.index[key], expiresAt: s.expiry[key]})
+	}
+	return &memCursor{entries: entries}, cut, nil
+}
+
+type memCursor struct {
+	entries []indexEntry
+}
+
+func (c *memCursor) next() (indexEntry, bool, error) {
+	if len(c.entries) == 0 {
+		return indexEntry{}, false, nil
+	}
+	e := c.entries[0]
+	c.entries = c.entries[1:]
+	return e, true, nil
+}
+
+func (c *memCursor) close() error {
+	return nil
+}
+
+type diskCursor struct {
+	f  *os.File
+	in *hintReader
+}
+
+func (c *diskCursor) next() (indexEntry, bool, error) {
+	if c.in.offset >= c.in.end {
+		return indexEntry{}, false, nil
+	}
+	e, err := c.in.next()
+	if err != nil {
+		return indexEntry{}, false, err
+	}
+	return e, true, nil
+}
+
+func (c *diskCursor) close() error {
+	return c.f.Close()
+}
+
+// openCursors creates cursors of all the segments, it has to be called under the database lock
+func openCursors(segments []*segment) ([]indexCursor, error) {
+	cursors, _, err := openRangeCursors(segments, "", "", 0)
+	return cursors, err
+}
+
+// openRangeCursors creates range cursors of all the segments, it has to be called under the database lock.
+// If the limit cuts some of them, the keys are complete only up to the returned bound, otherwise it's empty
+func openRangeCursors(segments []*segment, start, end string, limit int) ([]indexCursor, string, error) {
+	var (
+		cursors []indexCursor
+		bound   string
+	)
+	for _, s := range segments {
+		c, cut, err := s.rangeCursor(start, end, limit)
+		if err != nil {
+			closeCursors(cursors)
+			return nil, "", err
+		}
+		if cut {
+			entries := c.(*memCursor).entries
+			if last := entries[len(entries)-1].key; bound == "" || last < bound {
+				bound = last
+			}
+		}
+		cursors = append(cursors, c)
+	}
+	return cursors, bound, nil
+}
+
+// prefixEnd returns the smallest key which is bigger than all the keys with the prefix, empty one if there is none
+func prefixEnd(prefix string) string {
+	for i := len(prefix) - 1; i >= 0; i-- {
+		if prefix[i] != 0xff {
+			return prefix[:i] + string([]byte{prefix[i] + 1})
+		}
+	}
+	return ""
+}
+
+func closeCursors(cursors []indexCursor) {
+	for _, c := range cursors {
+		c.close()
+	}
+}
+
+// mergeKeys walks the keys of all the segments in the key order and calls visit once for every key with the entry
+// of the newest segment which has it, so it needs memory only for a single entry per segment. Segments and their
+// cursors go from the newest to the oldest; visit may stop the walk by returning false
+func mergeKeys(segments []*segment, cursors []indexCursor, visit func(s *segment, e indexEntry) (bool, error)) error {
+	heads := make([]indexEntry, len(cursors))
+	ok := make([]bool, len(cursors))
+	for i, c := range cursors {
+		var err error
+		if heads[i], ok[i], err = c.next(); err != nil {
+			return err
+		}
+	}
+
+	for {
+		// the newest segment wins when several of them have the smallest key
+		min := -1
+		for i := range heads {
+			if ok[i] && (min < 0 || heads[i].key < heads[min].key) {
+				min = i
+			}
+		}
+		if min < 0 {
+			return nil
+		}
+
+		key := heads[min].key
+		more, err := visit(segments[min], heads[min])
+		if err != nil || !more {
+			return err
+		}
+		for i := range heads {
+			if ok[i] && heads[i].key == key {
+				if heads[i], ok[i], err = cursors[i].next(); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package datastore
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Record is a single key operation read from a segment file. It's used by the tools working with the files
+// of a closed database, the running database never exposes its records
+type Record struct {
+	// Offset is the position of the key operation in the file, the one the index points to
+	Offset    int64
+	Key       string
+	Value     string
+	Deleted   bool
+	ExpiresAt int64
+	Version   uint64
+	// Batch is set for the operations written by WriteBatch
+	Batch bool
+	// Encrypted value holds the sealed payload, Keyring.Decrypt returns the plain one
+	Encrypted bool
+}
+
+// SegmentFiles returns paths of all segment files in dir in the order they were written, the oldest first
+func SegmentFiles(dir string) ([]string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var res []string
+	for _, fi := range files {
+		if isSegmentFile(fi.Name()) {
+			res = append(res, filepath.Join(dir, fi.Name()))
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return segmentOrder(res[i]) < segmentOrder(res[j])
+	})
+	return res, nil
+}
+
+// ReadSegment calls visit for every record of the segment file. Corrupted records are skipped when their size
+// is known, otherwise the rest of the file is treated as damaged; all of them are returned as corruptions
+func ReadSegment(path string, visit func(r Record)) ([]Corruption, error) {
+	input, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer input.Close()
+
+	fi, err := input.Stat()
+	if err != nil {
+		return nil, err
+	}
+	fileSize := fi.Size()
+
+	s := newSegment(path)
+	if err := s.readFormat(input, fileSize); err == ErrCorrupted {
+		return []Corruption{{Path: path, Offset: 0, Size: fileSize}}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	in := bufio.NewReaderSize(io.NewSectionReader(input, s.offset, fileSize-s.offset), bufSize)
+	var corruptions []Corruption
+	for {
+		size, err := s.readRecords(in, fileSize, func(offset int64, entries []*entry, positions []int64) {
+			for i, e := range entries {
+				visit(Record{
+					Offset:    offset + positions[i],
+					Key:       e.key,
+					Value:     e.value,
+					Deleted:   e.deleted,
+					ExpiresAt: e.expiresAt,
+					Version:   e.version,
+					Batch:     len(entries) > 1 || positions[i] != 0,
+					Encrypted: e.encrypted,
+				})
+			}
+		})
+		if err != ErrCorrupted {
+			return corruptions, err
+		}
+
+		if size == 0 {
+			return append(corruptions, Corruption{Path: path, Offset: s.offset, Size: fileSize - s.offset}), nil
+		}
+		corruptions = append(corruptions, Corruption{Path: path, Offset: s.offset, Size: size})
+		s.offset += size
+	}
+}
+
+// TruncateSegment cuts the segment file at its first corrupted record and returns the number of removed bytes.
+// The valid records written after the corrupted one are lost, so it's meant for the damaged tails only
+func TruncateSegment(path string) (int64, error) {
+	lock, err := lockDir(filepath.Dir(path))
+	if err != nil {
+		return 0, err
+	}
+	defer lock.release()
+
+	corruptions, err := ReadSegment(path, func(Record) {})
+	if err != nil || len(corruptions) == 0 {
+		return 0, err
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	offset := corruptions[0].Offset
+	if err := os.Truncate(path, offset); err != nil {
+		return 0, err
+	}
+	// the hint and the bloom filter describe the file before truncation
+	s := newSegment(path)
+	s.removeHint()
+	s.removeFilter()
+	return fi.Size() - offset, nil
+}
+
+// Compact merges all the segments in dir into one the same way the database does it while running, the database
+// in dir must be closed
+func Compact(dir string, opts Options) error {
+	opts.AutoMergeEnabled = false
+	db, err := NewDbWithOptions(dir, opts)
+	if err != nil {
+		return err
+	}
+
+	// the active segment is sealed, so its records are merged too
+	if db.segments[0].offset > db.segments[0].headerSize() {
+		if _, err := db.addSegment(); err != nil {
+			db.Close()
+			return err
+		}
+	}
+	if err := db.merge(); err != nil {
+		db.Close()
+		return err
+	}
+	return db.Close()
+}
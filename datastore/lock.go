@@ -0,0 +1,78 @@
+package datastore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// lock file keeps other processes from opening the same directory. The lock itself is taken on the open file,
+// so the system releases it when the process dies; the file keeps the pid of the owner, which is cleared
+// on close, so a pid found on open tells that the previous owner has crashed
+const lockFileName = "LOCK"
+
+var ErrLocked = fmt.Errorf("database directory is locked by another process")
+
+type dirLock struct {
+	f *os.File
+}
+
+func lockDir(dir string) (*dirLock, error) {
+	path := filepath.Join(dir, lockFileName)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	owner := strings.TrimSpace(string(data))
+
+	if err := lockFile(f); err != nil {
+		f.Close()
+		if err == errWouldBlock {
+			if owner == "" {
+				return nil, fmt.Errorf("%w: %s", ErrLocked, dir)
+			}
+			return nil, fmt.Errorf("%w: %s is used by pid %s", ErrLocked, dir, owner)
+		}
+		return nil, err
+	}
+	if owner != "" {
+		log.Printf("stale lock of %s is left by pid %s, which was not closed properly", dir, owner)
+	}
+
+	l := &dirLock{f: f}
+	if err := l.setOwner(strconv.Itoa(os.Getpid())); err != nil {
+		l.release()
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *dirLock) setOwner(owner string) error {
+	if err := l.f.Truncate(0); err != nil {
+		return err
+	}
+	_, err := l.f.WriteAt([]byte(owner), 0)
+	return err
+}
+
+// release clears the owner, so the next open doesn't take the lock for a stale one
+func (l *dirLock) release() error {
+	err := l.setOwner("")
+	if unlockErr := unlockFile(l.f); err == nil {
+		err = unlockErr
+	}
+	if closeErr := l.f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
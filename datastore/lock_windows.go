@@ -0,0 +1,47 @@
+//go:build windows
+// +build windows
+
+package datastore
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	lockfileFailImmediately = 0x1
+	lockfileExclusiveLock   = 0x2
+)
+
+var (
+	kernel32         = syscall.NewLazyDLL("kernel32.dll")
+	procLockFileEx   = kernel32.NewProc("LockFileEx")
+	procUnlockFileEx = kernel32.NewProc("UnlockFileEx")
+)
+
+// ERROR_LOCK_VIOLATION
+var errWouldBlock = syscall.Errno(33)
+
+// windows locks are mandatory, so a single byte far beyond the pid is locked instead of the whole file,
+// the other processes still can read the pid of the owner
+func lockRange() *syscall.Overlapped {
+	return &syscall.Overlapped{OffsetHigh: 0x7fffffff}
+}
+
+func lockFile(f *os.File) error {
+	r, _, err := procLockFileEx.Call(f.Fd(), lockfileExclusiveLock|lockfileFailImmediately, 0, 1, 0,
+		uintptr(unsafe.Pointer(lockRange())))
+	if r == 0 {
+		return err
+	}
+	return nil
+}
+
+func unlockFile(f *os.File) error {
+	r, _, err := procUnlockFileEx.Call(f.Fd(), 0, 1, 0, uintptr(unsafe.Pointer(lockRange())))
+	if r == 0 {
+		return err
+	}
+	return nil
+}
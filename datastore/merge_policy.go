@@ -0,0 +1,145 @@
+package datastore
+
+import (
+	"log"
+	"path/filepath"
+	"time"
+)
+
+// how often the merge policy is asked when nothing is written, so the time based policies get their chance
+const mergeCheckInterval = time.Minute
+
+// MergeState describes the sealed segments, the ones merge works with
+type MergeState struct {
+	// Segments are the sealed segments, the newest first
+	Segments []SegmentStats
+	// GarbageRatio is the share of the sealed segments records which are overwritten, deleted or expired by the
+	// newer sealed records. It's left zero for the built-in policies which don't use it
+	GarbageRatio float64
+	Now          time.Time
+	LastMerge    time.Time
+}
+
+// MergePolicy decides when the sealed segments are merged. It's asked every time a segment is sealed
+// and periodically, so it shouldn't take long
+type MergePolicy interface {
+	ShouldMerge(state MergeState) bool
+}
+
+// SegmentCountPolicy merges when there are more than MaxSegments sealed segments
+type SegmentCountPolicy struct {
+	MaxSegments int
+}
+
+func (p SegmentCountPolicy) ShouldMerge(state MergeState) bool {
+	return len(state.Segments) > p.MaxSegments
+}
+
+// GarbageRatioPolicy merges when at least Ratio of the sealed records would be dropped by merge
+type GarbageRatioPolicy struct {
+	Ratio float64
+}
+
+func (p GarbageRatioPolicy) ShouldMerge(state MergeState) bool {
+	return len(state.Segments) > 0 && state.GarbageRatio >= p.Ratio
+}
+
+// SizeTieredPolicy merges when the segments sealed after the last merge together are at least Ratio times bigger
+// than the merged one and there are at least MinSegments of them, so large databases aren't rewritten for every
+// new segment
+type SizeTieredPolicy struct {
+	MinSegments int
+	Ratio       float64
+}
+
+func (p SizeTieredPolicy) ShouldMerge(state MergeState) bool {
+	var merged, fresh int64
+	count := 0
+	for _, s := range state.Segments {
+		if s.Name == segmentPrefix+mergedSuffix {
+			merged = s.Size
+			continue
+		}
+		fresh += s.Size
+		count++
+	}
+	return count >= p.MinSegments && float64(fresh) >= p.Ratio*float64(merged)
+}
+
+// ScheduledPolicy allows merges only in the daily time window from Start to End, given as the time since midnight
+// in the local time zone; the window may cross midnight. Inside the window the decision is made by Policy
+type ScheduledPolicy struct {
+	Start  time.Duration
+	End    time.Duration
+	Policy MergePolicy
+}
+
+func (p ScheduledPolicy) ShouldMerge(state MergeState) bool {
+	year, month, day := state.Now.Date()
+	sinceMidnight := state.Now.Sub(time.Date(year, month, day, 0, 0, 0, 0, state.Now.Location()))
+
+	inWindow := sinceMidnight >= p.Start && sinceMidnight < p.End
+	if p.Start > p.End {
+		inWindow = sinceMidnight >= p.Start || sinceMidnight < p.End
+	}
+	return inWindow && p.Policy.ShouldMerge(state)
+}
+
+func defaultMergePolicy() MergePolicy {
+	return SegmentCountPolicy{MaxSegments: 1}
+}
+
+// needsGarbageRatio tells whether the policy reads MergeState.GarbageRatio, which takes a pass over the indexes
+// of all the sealed segments. Unknown policies may read it, so they always get it
+func needsGarbageRatio(policy MergePolicy) bool {
+	switch p := policy.(type) {
+	case SegmentCountPolicy, SizeTieredPolicy:
+		return false
+	case ScheduledPolicy:
+		return needsGarbageRatio(p.Policy)
+	}
+	return true
+}
+
+// mergeState collects the state for the merge policy, garbage ratio is computed only when it's asked for
+func (db *Db) mergeState(garbage bool) MergeState {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	state := MergeState{Now: now(), LastMerge: db.lastMerge}
+	records := 0
+	sealed := db.segments[1:]
+	for _, s := range sealed {
+		state.Segments = append(state.Segments, SegmentStats{
+			Name:    filepath.Base(s.path),
+			Size:    s.offset,
+			Records: s.records,
+			Keys:    s.keyCount(),
+		})
+		records += s.records
+	}
+	if !garbage || records == 0 {
+		return state
+	}
+
+	// merge doesn't touch the active segment, so the sealed records which its keys hide are not counted as
+	// garbage: merge can't drop them
+	t := state.Now.UnixNano()
+	live := 0
+	cursors, err := openCursors(sealed)
+	if err == nil {
+		defer closeCursors(cursors)
+		err = mergeKeys(sealed, cursors, func(s *segment, e indexEntry) (bool, error) {
+			if e.alive(t) {
+				live++
+			}
+			return true, nil
+		})
+	}
+	if err != nil {
+		log.Printf("cannot read segment indexes: %v", err)
+		return state
+	}
+	state.GarbageRatio = float64(records-live) / float64(records)
+	return state
+}
@@ -0,0 +1,75 @@
+package datastore
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMergePolicy(t *testing.T) {
+	sealed := func(sizes ...int64) []SegmentStats {
+		var res []SegmentStats
+		for i, size := range sizes {
+			name := segmentPrefix + mergedSuffix
+			if i < len(sizes)-1 {
+				name = segmentPrefix + string(rune('0'+i))
+			}
+			res = append(res, SegmentStats{Name: name, Size: size})
+		}
+		return res
+	}
+	at := func(hour, minute int) time.Time {
+		return time.Date(2021, 5, 20, hour, minute, 0, 0, time.Local)
+	}
+
+	tests := []struct {
+		name   string
+		policy MergePolicy
+		state  MergeState
+		merge  bool
+	}{
+		{"count below", SegmentCountPolicy{MaxSegments: 2}, MergeState{Segments: sealed(10, 10)}, false},
+		{"count above", SegmentCountPolicy{MaxSegments: 2}, MergeState{Segments: sealed(10, 10, 10)}, true},
+		{"garbage below", GarbageRatioPolicy{Ratio: 0.5}, MergeState{Segments: sealed(10), GarbageRatio: 0.4}, false},
+		{"garbage above", GarbageRatioPolicy{Ratio: 0.5}, MergeState{Segments: sealed(10), GarbageRatio: 0.6}, true},
+		{"garbage without segments", GarbageRatioPolicy{Ratio: 0}, MergeState{}, false},
+		{"tiered small", SizeTieredPolicy{MinSegments: 2, Ratio: 1}, MergeState{Segments: sealed(10, 10, 100)}, false},
+		{"tiered big", SizeTieredPolicy{MinSegments: 2, Ratio: 1}, MergeState{Segments: sealed(60, 50, 100)}, true},
+		{"tiered few", SizeTieredPolicy{MinSegments: 3, Ratio: 1}, MergeState{Segments: sealed(60, 50, 100)}, false},
+		{"tiered without merged", SizeTieredPolicy{MinSegments: 2, Ratio: 1}, MergeState{Segments: []SegmentStats{
+			{Name: segmentPrefix + "1", Size: 10}, {Name: segmentPrefix + "0", Size: 10},
+		}}, true},
+		{"window inside", ScheduledPolicy{Start: time.Hour, End: 5 * time.Hour, Policy: SegmentCountPolicy{}},
+			MergeState{Segments: sealed(10), Now: at(3, 0)}, true},
+		{"window outside", ScheduledPolicy{Start: time.Hour, End: 5 * time.Hour, Policy: SegmentCountPolicy{}},
+			MergeState{Segments: sealed(10), Now: at(5, 0)}, false},
+		{"window over midnight", ScheduledPolicy{Start: 23 * time.Hour, End: time.Hour, Policy: SegmentCountPolicy{}},
+			MergeState{Segments: sealed(10), Now: at(0, 30)}, true},
+		{"window over midnight outside", ScheduledPolicy{Start: 23 * time.Hour, End: time.Hour, Policy: SegmentCountPolicy{}},
+			MergeState{Segments: sealed(10), Now: at(12, 0)}, false},
+		{"window inner policy", ScheduledPolicy{Start: time.Hour, End: 5 * time.Hour, Policy: SegmentCountPolicy{MaxSegments: 1}},
+			MergeState{Segments: sealed(10), Now: at(3, 0)}, false},
+	}
+	for _, tc := range tests {
+		if merge := tc.policy.ShouldMerge(tc.state); merge != tc.merge {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.merge, merge)
+		}
+	}
+}
+
+func TestNeedsGarbageRatio(t *testing.T) {
+	tests := []struct {
+		policy MergePolicy
+		needs  bool
+	}{
+		{SegmentCountPolicy{MaxSegments: 1}, false},
+		{SizeTieredPolicy{MinSegments: 2, Ratio: 1}, false},
+		{GarbageRatioPolicy{Ratio: 0.5}, true},
+		{ScheduledPolicy{Policy: SegmentCountPolicy{}}, false},
+		{ScheduledPolicy{Policy: GarbageRatioPolicy{Ratio: 0.5}}, true},
+	}
+	for _, tc := range tests {
+		if needs := needsGarbageRatio(tc.policy); needs != tc.needs {
+			t.Errorf("%T: expected %v, got %v", tc.policy, tc.needs, needs)
+		}
+	}
+}
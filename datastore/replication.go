@@ -0,0 +1,352 @@
+package datastore
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+const defReplicationLogSize = 8 * 1024 * 1024
+
+// ErrLogTruncated means that the changes after the requested version are not kept anymore,
+// so a follower has to start from a snapshot
+var ErrLogTruncated = fmt.Errorf("requested changes are not in the replication log anymore")
+
+// changeLog keeps encoded records of the latest writes, so followers can fetch them without reading segments
+type changeLog struct {
+	mux sync.Mutex
+	// version of the last record which isn't kept anymore
+	start   uint64
+	records []loggedRecord
+	size    int
+	maxSize int
+	// changed is closed and replaced every time new records are added
+	changed chan struct{}
+}
+
+// loggedRecord is either the encoded record or the place of the record in the segment file. Records of the streamed
+// values are too big to keep them in memory, so they are read from the file when followers ask for them
+type loggedRecord struct {
+	data     []byte
+	file     *os.File
+	position int64
+	length   int64
+	version  uint64
+}
+
+// only the reference to the record in the segment file is kept in memory
+const fileRecordCost = 64
+
+func newChangeLog(version uint64, maxSize int) *changeLog {
+	return &changeLog{
+		start:   version,
+		maxSize: maxSize,
+		changed: make(chan struct{}),
+	}
+}
+
+func (r loggedRecord) cost() int {
+	if r.file != nil {
+		return fileRecordCost
+	}
+	return len(r.data)
+}
+
+func (l *changeLog) append(record []byte, version uint64) {
+	l.add(loggedRecord{data: record, version: version})
+}
+
+// appendFile logs the record of the given length written to the segment file at the position
+func (l *changeLog) appendFile(f *os.File, position, length int64, version uint64) {
+	l.add(loggedRecord{file: f, position: position, length: length, version: version})
+}
+
+func (l *changeLog) add(record loggedRecord) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	l.records = append(l.records, record)
+	l.size += record.cost()
+
+	drop := 0
+	for l.size > l.maxSize && drop < len(l.records) {
+		l.size -= l.records[drop].cost()
+		l.start = l.records[drop].version
+		drop++
+	}
+	if drop > 0 {
+		l.records = append([]loggedRecord(nil), l.records[drop:]...)
+	}
+
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+func (l *changeLog) after(version uint64) ([]byte, <-chan struct{}, error) {
+	l.mux.Lock()
+	last := l.start
+	if len(l.records) > 0 {
+		last = l.records[len(l.records)-1].version
+	}
+	if version < l.start || version > last {
+		l.mux.Unlock()
+		return nil, nil, ErrLogTruncated
+	}
+	var records []loggedRecord
+	for _, r := range l.records {
+		if r.version > version {
+			records = append(records, r)
+		}
+	}
+	changed := l.changed
+	l.mux.Unlock()
+
+	// segment files are read without the lock, so the writes don't wait for them
+	var res []byte
+	for _, r := range records {
+		if r.file == nil {
+			res = append(res, r.data...)
+			continue
+		}
+		data := make([]byte, r.length)
+		if _, err := r.file.ReadAt(data, r.position); err != nil {
+			// the segment is closed once it's merged, then the record is only in a snapshot
+			if errors.Is(err, os.ErrClosed) {
+				return nil, nil, ErrLogTruncated
+			}
+			return nil, nil, err
+		}
+		res = append(res, data...)
+	}
+	return res, changed, nil
+}
+
+// LastVersion returns the version of the latest write available to readers
+func (db *Db) LastVersion() uint64 {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+	return db.indexedVersion
+}
+
+// Changes returns encoded records written after the given version. If there are no such records yet,
+// it waits for them at most for the given time and returns nothing if nothing has been written
+func (db *Db) Changes(after uint64, wait time.Duration) ([]byte, error) {
+	records, changed, err := db.changes.after(after)
+	if err != nil || len(records) > 0 || wait <= 0 {
+		return records, err
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-changed:
+		records, _, err = db.changes.after(after)
+		return records, err
+	case <-timer.C:
+		return nil, nil
+	}
+}
+
+// ApplyChanges writes the records received from the leader keeping their versions and returns the last of them
+func (db *Db) ApplyChanges(records []byte) (uint64, error) {
+	in := bufio.NewReader(bytes.NewReader(records))
+	var last uint64
+	for {
+		data, err := readRecord(in, int64(len(records)), FormatVersion)
+		if err == io.EOF {
+			return last, nil
+		}
+		if err != nil {
+			return last, err
+		}
+
+		entries, _, err := decodeRecord(data)
+		if err != nil {
+			return last, err
+		}
+		if len(entries) == 0 {
+			continue
+		}
+		if err := db.send(putEntry{entries: entries, replicated: true}); err != nil {
+			return last, err
+		}
+		last = lastVersion(entries)
+	}
+}
+
+// Snapshot is a consistent view of all the live records of the database at Version
+type Snapshot struct {
+	Version  uint64
+	files    map[*segment]*os.File
+	segments []*segment
+	cursors  []indexCursor
+	// the records which expire after the snapshot is taken are still written
+	taken int64
+}
+
+// Snapshot captures the index cursors and the files of all the segments, the records are walked and read later
+// by WriteTo, so the snapshot is written once and has to be closed to release segment files
+func (db *Db) Snapshot() (*Snapshot, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+	return db.snapshot()
+}
+
+// snapshot is called under the lock, nothing but the files and the cursors is opened there
+func (db *Db) snapshot() (*Snapshot, error) {
+	snapshot := &Snapshot{
+		Version:  db.indexedVersion,
+		files:    make(map[*segment]*os.File),
+		segments: make([]*segment, len(db.segments)),
+		taken:    now().UnixNano(),
+	}
+	copy(snapshot.segments, db.segments)
+	for _, s := range snapshot.segments {
+		// files are opened right away, so merge may remove them before the snapshot is written
+		f, err := s.openFile()
+		if err != nil {
+			snapshot.Close()
+			return nil, err
+		}
+		snapshot.files[s] = f
+	}
+	cursors, err := openCursors(snapshot.segments)
+	if err != nil {
+		snapshot.Close()
+		return nil, err
+	}
+	snapshot.cursors = cursors
+	return snapshot, nil
+}
+
+// WriteTo writes all the live records of the snapshot in the key order, they are read one by one
+func (s *Snapshot) WriteTo(w io.Writer) (int64, error) {
+	var written int64
+	err := mergeKeys(s.segments, s.cursors, func(seg *segment, e indexEntry) (bool, error) {
+		if !e.alive(s.taken) {
+			return true, nil
+		}
+		n, err := s.writeRecord(w, seg, e.position)
+		written += n
+		return err == nil, err
+	})
+	return written, err
+}
+
+func (s *Snapshot) writeRecord(w io.Writer, seg *segment, position int64) (int64, error) {
+	f := s.files[seg]
+	// records of the current format are copied as they are, so big values are not held in memory
+	if seg.version == FormatVersion {
+		var header [4]byte
+		if _, err := f.ReadAt(header[:], position); err != nil {
+			return 0, err
+		}
+		return io.Copy(w, io.NewSectionReader(f, position, int64(binary.LittleEndian.Uint32(header[:]))))
+	}
+
+	in := bufio.NewReader(io.NewSectionReader(f, position, maxRecordSize))
+	data, err := readRecord(in, maxRecordSize, seg.version)
+	if err == nil {
+		// followers get the records in the current format
+		data, err = upgradeRecord(data, seg.version)
+	}
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(data)
+	return int64(n), err
+}
+
+func (s *Snapshot) Close() error {
+	closeCursors(s.cursors)
+	s.cursors = nil
+	var err error
+	for _, f := range s.files {
+		if closeErr := f.Close(); closeErr != nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// ApplySnapshot replaces the content of the database with the snapshot records read from r: they are written
+// keeping their versions, and the keys which are not in the snapshot are deleted. The records come in the key
+// order, so the keys are compared with the existing ones a chunk at a time
+func (db *Db) ApplySnapshot(r io.Reader, version uint64) error {
+	in := bufio.NewReaderSize(r, bufSize)
+	keys := make(map[string]bool)
+	start, last := "", ""
+	for {
+		data, err := readRecord(in, maxRecordSize, FormatVersion)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		entries, _, err := decodeRecord(data)
+		if err != nil {
+			return err
+		}
+		if len(entries) == 0 {
+			continue
+		}
+		for _, e := range entries {
+			if len(keys) > 0 && e.key <= last {
+				return fmt.Errorf("snapshot key %q comes after %q", e.key, last)
+			}
+			keys[e.key] = true
+			last = e.key
+		}
+		if err := db.send(putEntry{entries: entries, replicated: true}); err != nil {
+			return err
+		}
+
+		if len(keys) >= snapshotChunkSize {
+			if err := db.removeMissing(start, last, keys, version); err != nil {
+				return err
+			}
+			start, keys = last+"\x00", make(map[string]bool)
+		}
+	}
+	return db.removeMissing(start, "", keys, version)
+}
+
+// the number of snapshot keys compared with the existing ones at once
+var snapshotChunkSize = 1024
+
+// removeMissing deletes the existing keys from start to end inclusive which are not among the keys,
+// empty end means no bound
+func (db *Db) removeMissing(start, end string, keys map[string]bool, version uint64) error {
+	for {
+		existing, err := db.scan("", start, snapshotChunkSize)
+		if err != nil {
+			return err
+		}
+		var removed []*entry
+		for _, key := range existing {
+			if end != "" && key > end {
+				break
+			}
+			if !keys[key] {
+				removed = append(removed, &entry{key: key, deleted: true, version: version})
+			}
+		}
+		if len(removed) > 0 {
+			if err := db.send(putEntry{entries: removed, replicated: true}); err != nil {
+				return err
+			}
+		}
+		if len(existing) < snapshotChunkSize || end != "" && existing[len(existing)-1] >= end {
+			return nil
+		}
+		start = existing[len(existing)-1] + "\x00"
+	}
+}
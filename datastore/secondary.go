@@ -0,0 +1,563 @@
+package datastore
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strings"
+)
+
+var ErrNoIndex = fmt.Errorf("field is not indexed")
+
+// bucketMeta is kept as the value of the registry record of the bucket, so the declared indexes are replicated,
+// backed up and dropped together with the bucket
+type bucketMeta struct {
+	Indexes []string `json:"indexes,omitempty"`
+}
+
+func parseBucketMeta(value string) (bucketMeta, error) {
+	var meta bucketMeta
+	if value == "" {
+		return meta, nil
+	}
+	err := json.Unmarshal([]byte(value), &meta)
+	return meta, err
+}
+
+// field values of different json types are ordered by the type: null < bool < number < string
+const (
+	nullField = iota
+	boolField
+	numberField
+	stringField
+)
+
+type fieldValue struct {
+	kind int
+	num  float64
+	str  string
+}
+
+// newFieldValue converts the json scalar, objects and arrays can't be indexed
+func newFieldValue(v interface{}) (fieldValue, bool) {
+	switch v := v.(type) {
+	case nil:
+		return fieldValue{kind: nullField}, true
+	case bool:
+		if v {
+			return fieldValue{kind: boolField, num: 1}, true
+		}
+		return fieldValue{kind: boolField}, true
+	case float64:
+		return fieldValue{kind: numberField, num: v}, true
+	case int:
+		return fieldValue{kind: numberField, num: float64(v)}, true
+	case int64:
+		return fieldValue{kind: numberField, num: float64(v)}, true
+	case string:
+		return fieldValue{kind: stringField, str: v}, true
+	}
+	return fieldValue{}, false
+}
+
+// kindStart returns the value which is less than all the values of the json type. Json has no infinities,
+// so no field value equals it
+func kindStart(kind int) fieldValue {
+	return fieldValue{kind: kind, num: math.Inf(-1)}
+}
+
+func (v fieldValue) compare(other fieldValue) int {
+	switch {
+	case v.kind != other.kind:
+		return v.kind - other.kind
+	case v.num < other.num || v.str < other.str:
+		return -1
+	case v.num > other.num || v.str > other.str:
+		return 1
+	}
+	return 0
+}
+
+type indexedKey struct {
+	value fieldValue
+	key   string
+}
+
+// fieldIndex keeps the keys of a bucket sorted by the value of the json field at path,
+// the keys whose values don't have the field are not in it
+type fieldIndex struct {
+	path   string
+	fields []string
+	values map[string]fieldValue
+	sorted *skipList
+	// touched keeps the keys written while the index is being built, the values the build has read for them
+	// are outdated. It's nil once the index is built
+	touched map[string]bool
+	// built is closed once the build is finished, err tells why it has failed
+	built chan struct{}
+	err   error
+}
+
+func checkIndexPath(path string) error {
+	for _, field := range strings.Split(path, ".") {
+		if field == "" {
+			return fmt.Errorf("bad index path %q", path)
+		}
+	}
+	return nil
+}
+
+func newFieldIndex(path string) *fieldIndex {
+	return &fieldIndex{
+		path:    path,
+		fields:  strings.Split(path, "."),
+		values:  make(map[string]fieldValue),
+		sorted:  newSkipList(nil),
+		touched: make(map[string]bool),
+		built:   make(chan struct{}),
+	}
+}
+
+// wait returns once the index is built
+func (idx *fieldIndex) wait() error {
+	<-idx.built
+	return idx.err
+}
+
+// field returns the value of the indexed field of the parsed json document
+func (idx *fieldIndex) field(doc interface{}) (fieldValue, bool) {
+	for _, field := range idx.fields {
+		object, ok := doc.(map[string]interface{})
+		if !ok {
+			return fieldValue{}, false
+		}
+		if doc, ok = object[field]; !ok {
+			return fieldValue{}, false
+		}
+	}
+	return newFieldValue(doc)
+}
+
+// set indexes the key by the field of the parsed json value, doc is nil for deleted keys and the values
+// which are not json
+func (idx *fieldIndex) set(key string, doc interface{}, parsed bool) {
+	if idx.touched != nil {
+		idx.touched[key] = true
+	}
+	if old, ok := idx.values[key]; ok {
+		idx.sorted.remove(indexedKey{value: old, key: key})
+		delete(idx.values, key)
+	}
+	if !parsed {
+		return
+	}
+	if value, ok := idx.field(doc); ok {
+		idx.sorted.insert(indexedKey{value: value, key: key})
+		idx.values[key] = value
+	}
+}
+
+// load adds the sorted keys read by the build to the keys written meanwhile, skipping the ones they have changed.
+// Both are already sorted, so the list is built once instead of inserting the keys one by one
+func (idx *fieldIndex) load(keys []indexedKey) {
+	items := make([]indexedKey, 0, len(keys)+len(idx.values))
+	n := idx.sorted.head.next[0]
+	for _, k := range keys {
+		if idx.touched[k.key] {
+			continue
+		}
+		for ; n != nil && lessIndexed(n.item, k); n = n.next[0] {
+			items = append(items, n.item)
+		}
+		items = append(items, k)
+		idx.values[k.key] = k.value
+	}
+	for ; n != nil; n = n.next[0] {
+		items = append(items, n.item)
+	}
+	idx.sorted = newSkipList(items)
+}
+
+// find returns the keys whose values are within the bounds, nil bound means no bound
+func (idx *fieldIndex) find(min, max *fieldValue) []string {
+	var n *skipNode
+	if min != nil {
+		n = idx.sorted.seek(indexedKey{value: *min}, nil)
+	} else {
+		n = idx.sorted.head.next[0]
+	}
+	var keys []string
+	for ; n != nil; n = n.next[0] {
+		if max != nil && n.item.value.compare(*max) > 0 {
+			break
+		}
+		keys = append(keys, n.item.key)
+	}
+	return keys
+}
+
+// updateSecondary keeps the secondary indexes in line with the entry added to the index of the active segment,
+// it's called under the write lock
+func (db *Db) updateSecondary(e *entry) {
+	if strings.HasPrefix(e.key, bucketRegistryPrefix) {
+		bucket := strings.TrimPrefix(e.key, bucketRegistryPrefix)
+		if added := db.loadIndexes(bucket, e); len(added) > 0 {
+			db.builds.Add(1)
+			go func() {
+				defer db.builds.Done()
+				db.buildIndexes(bucket, added)
+			}()
+		}
+		return
+	}
+	bucket, key, ok := splitBucketKey(e.key)
+	indexes := db.secondary[bucket]
+	if !ok || len(indexes) == 0 {
+		return
+	}
+
+	var doc interface{}
+	parsed := !e.deleted && json.Unmarshal([]byte(e.value), &doc) == nil
+	for _, idx := range indexes {
+		idx.set(key, doc, parsed)
+	}
+}
+
+// loadIndexes applies the registry record of the bucket under the lock: the indexes which are not declared anymore
+// are dropped, and the new ones start following the writes right away. They are returned to be built from the values
+// already written
+func (db *Db) loadIndexes(bucket string, registry *entry) []*fieldIndex {
+	if registry.deleted {
+		delete(db.secondary, bucket)
+		return nil
+	}
+	meta, err := parseBucketMeta(registry.value)
+	if err != nil {
+		log.Printf("cannot read indexes of bucket %s: %v", bucket, err)
+		return nil
+	}
+
+	var indexes, added []*fieldIndex
+	for _, path := range meta.Indexes {
+		idx := db.findIndex(bucket, path)
+		if idx == nil {
+			idx = newFieldIndex(path)
+			added = append(added, idx)
+		}
+		indexes = append(indexes, idx)
+	}
+	if len(indexes) == 0 {
+		delete(db.secondary, bucket)
+	} else {
+		db.secondary[bucket] = indexes
+	}
+	return added
+}
+
+func (db *Db) findIndex(bucket, path string) *fieldIndex {
+	for _, idx := range db.secondary[bucket] {
+		if idx.path == path {
+			return idx
+		}
+	}
+	return nil
+}
+
+// buildsDone is closed once the running builds of the indexes are finished
+func (db *Db) buildsDone() chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		db.builds.Wait()
+		close(done)
+	}()
+	return done
+}
+
+// buildIndexes fills the new indexes of the bucket with the values already written. The values are read without
+// the lock, so the database is used as usual meanwhile: the indexes follow the writes from the moment they are
+// declared, and the values read for the keys written since then are dropped when the build is added under the lock.
+// The indexes which can't be built are dropped, so they are reported missing until they are created again
+func (db *Db) buildIndexes(bucket string, indexes []*fieldIndex) {
+	keys, err := db.readIndexed(bucket, indexes)
+
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	for i, idx := range indexes {
+		if err != nil {
+			idx.err = err
+			db.dropIndex(bucket, idx)
+		} else {
+			idx.load(keys[i])
+		}
+		idx.touched = nil
+		close(idx.built)
+	}
+	if err != nil {
+		log.Printf("cannot build indexes of bucket %s: %v", bucket, err)
+	}
+}
+
+// dropIndex removes the index from the indexes of the bucket unless it has been replaced already
+func (db *Db) dropIndex(bucket string, idx *fieldIndex) {
+	indexes := db.secondary[bucket]
+	for i, other := range indexes {
+		if other == idx {
+			indexes = append(indexes[:i:i], indexes[i+1:]...)
+			break
+		}
+	}
+	if len(indexes) == 0 {
+		delete(db.secondary, bucket)
+	} else {
+		db.secondary[bucket] = indexes
+	}
+}
+
+// readIndexed returns the indexed fields of all the live values of the bucket sorted by the field values. The segments
+// are pinned under the lock, so merge may remove them while they are read
+func (db *Db) readIndexed(bucket string, indexes []*fieldIndex) ([][]indexedKey, error) {
+	prefix := bucketKey(bucket, "")
+	db.mux.RLock()
+	segments := make([]*segment, len(db.segments))
+	copy(segments, db.segments)
+	files := make(map[*segment]*os.File)
+	var err error
+	for _, s := range segments {
+		if files[s], err = s.openFile(); err != nil {
+			break
+		}
+	}
+	var cursors []indexCursor
+	if err == nil {
+		cursors, _, err = openRangeCursors(segments, prefix, prefixEnd(prefix), 0)
+	}
+	db.mux.RUnlock()
+	defer func() {
+		for _, f := range files {
+			if f != nil {
+				f.Close()
+			}
+		}
+	}()
+	if err != nil {
+		return nil, err
+	}
+	defer closeCursors(cursors)
+
+	t := now().UnixNano()
+	keys := make([][]indexedKey, len(indexes))
+	err = mergeKeys(segments, cursors, func(s *segment, ie indexEntry) (bool, error) {
+		if ie.key < prefix || !ie.alive(t) {
+			return true, nil
+		}
+		if !strings.HasPrefix(ie.key, prefix) {
+			return false, nil
+		}
+		e, err := readEntryAt(files[s], ie.position, s.version)
+		if err == nil {
+			err = db.keys.decrypt(e)
+		}
+		if err != nil {
+			return false, fmt.Errorf("cannot read %s from %s: %w", ie.key, s.path, err)
+		}
+
+		var doc interface{}
+		if json.Unmarshal([]byte(e.value), &doc) != nil {
+			return true, nil
+		}
+		for i, idx := range indexes {
+			if value, ok := idx.field(doc); ok {
+				keys[i] = append(keys[i], indexedKey{value: value, key: ie.key[len(prefix):]})
+			}
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range keys {
+		k := k
+		sort.Slice(k, func(i, j int) bool {
+			return lessIndexed(k[i], k[j])
+		})
+	}
+	return keys, nil
+}
+
+// loadSecondary builds the indexes of all the buckets while the database is opened. The indexes of an encrypted
+// database opened without the key are left unbuilt, so it still can be merged or inspected
+func (db *Db) loadSecondary() error {
+	buckets, err := db.Buckets()
+	if err != nil {
+		return err
+	}
+	for _, bucket := range buckets {
+		registry, err := db.getEntry(bucketRegistryPrefix + bucket)
+		if err == ErrNoKey {
+			log.Printf("indexes of bucket %s are not built: %v", bucket, err)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		// nothing else uses the database yet, so the indexes are built right away
+		if added := db.loadIndexes(bucket, registry); len(added) > 0 {
+			db.buildIndexes(bucket, added)
+		}
+	}
+	return nil
+}
+
+// indexed tells whether the key belongs to a bucket with indexes, it's called under the lock
+func (db *Db) indexed(key string) bool {
+	bucket, _, ok := splitBucketKey(key)
+	return ok && len(db.secondary[bucket]) > 0
+}
+
+// updateMeta rewrites the registry record of the bucket changed by update, nothing is written
+// when update returns false
+func (b *Bucket) updateMeta(update func(meta *bucketMeta) (bool, error)) error {
+	return b.db.send(putEntry{prepare: func() ([]*entry, error) {
+		registry, err := b.db.getEntry(bucketRegistryPrefix + b.name)
+		if err == ErrNotFound {
+			return nil, ErrBucketNotFound
+		}
+		if err != nil {
+			return nil, err
+		}
+		meta, err := parseBucketMeta(registry.value)
+		if err != nil {
+			return nil, err
+		}
+		changed, err := update(&meta)
+		if err != nil || !changed {
+			return nil, err
+		}
+		value, err := json.Marshal(meta)
+		if err != nil {
+			return nil, err
+		}
+		return []*entry{{key: registry.key, value: string(value)}}, nil
+	}})
+}
+
+// CreateIndex declares the index of the json field at the dot separated path, it's built from the values
+// already in the bucket before the call returns. Only scalar fields are indexed
+func (b *Bucket) CreateIndex(path string) error {
+	if err := checkIndexPath(path); err != nil {
+		return err
+	}
+	err := b.updateMeta(func(meta *bucketMeta) (bool, error) {
+		for _, p := range meta.Indexes {
+			if p == path {
+				// the index is dropped when its build fails, the registry is written again to retry it
+				b.db.mux.RLock()
+				idx := b.db.findIndex(b.name, path)
+				b.db.mux.RUnlock()
+				return idx == nil, nil
+			}
+		}
+		meta.Indexes = append(meta.Indexes, path)
+		return true, nil
+	})
+	if err != nil {
+		return err
+	}
+	// the index is built in the background, it's returned once it can be used
+	b.db.mux.RLock()
+	idx := b.db.findIndex(b.name, path)
+	b.db.mux.RUnlock()
+	if idx == nil {
+		return ErrNoIndex
+	}
+	return idx.wait()
+}
+
+func (b *Bucket) DropIndex(path string) error {
+	return b.updateMeta(func(meta *bucketMeta) (bool, error) {
+		for i, p := range meta.Indexes {
+			if p == path {
+				meta.Indexes = append(meta.Indexes[:i], meta.Indexes[i+1:]...)
+				return true, nil
+			}
+		}
+		return false, ErrNoIndex
+	})
+}
+
+// Indexes returns the paths of the indexed fields
+func (b *Bucket) Indexes() ([]string, error) {
+	b.db.mux.RLock()
+	defer b.db.mux.RUnlock()
+	var paths []string
+	for _, idx := range b.db.secondary[b.name] {
+		paths = append(paths, idx.path)
+	}
+	return paths, nil
+}
+
+// Find returns the keys whose json field at path equals the value in sorted order
+func (b *Bucket) Find(path string, value interface{}) ([]string, error) {
+	v, ok := newFieldValue(value)
+	if !ok {
+		return nil, fmt.Errorf("cannot compare %v with json fields", value)
+	}
+	return b.find(path, &v, &v)
+}
+
+// FindRange returns the keys whose json field at path is within min and max inclusive in the order of the field
+// values, nil bound means no bound. Bounds are json scalars: strings, numbers or booleans. The range with a single
+// bound doesn't leave the json type of the bound, e.g. min 5 finds the numbers from 5 but no strings
+func (b *Bucket) FindRange(path string, min, max interface{}) ([]string, error) {
+	var bounds [2]*fieldValue
+	for i, bound := range []interface{}{min, max} {
+		if bound == nil {
+			continue
+		}
+		v, ok := newFieldValue(bound)
+		if !ok {
+			return nil, fmt.Errorf("cannot compare %v with json fields", bound)
+		}
+		bounds[i] = &v
+	}
+	switch {
+	case bounds[0] != nil && bounds[1] == nil:
+		end := kindStart(bounds[0].kind + 1)
+		bounds[1] = &end
+	case bounds[0] == nil && bounds[1] != nil:
+		start := kindStart(bounds[1].kind)
+		bounds[0] = &start
+	}
+	return b.find(path, bounds[0], bounds[1])
+}
+
+func (b *Bucket) find(path string, min, max *fieldValue) ([]string, error) {
+	b.db.mux.RLock()
+	idx := b.db.findIndex(b.name, path)
+	b.db.mux.RUnlock()
+	if idx == nil {
+		return nil, ErrNoIndex
+	}
+	if err := idx.wait(); err != nil {
+		return nil, fmt.Errorf("cannot build index %s: %w", path, err)
+	}
+	b.db.mux.RLock()
+	keys := idx.find(min, max)
+	b.db.mux.RUnlock()
+
+	// expired values are still in the index
+	live := keys[:0]
+	for _, key := range keys {
+		exists, err := b.db.exists(b.key(key))
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			live = append(live, key)
+		}
+	}
+	return live, nil
+}
@@ -0,0 +1,41 @@
+package datastore
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFieldIndex_Load(t *testing.T) {
+	idx := newFieldIndex("age")
+	// the writes made while the index is being built
+	idx.set("ann", map[string]interface{}{"age": 40.0}, true)
+	idx.set("bob", nil, false)
+	idx.set("eve", map[string]interface{}{"age": 20.0}, true)
+
+	// the build has read the values written before
+	number := func(n float64) fieldValue { return fieldValue{kind: numberField, num: n} }
+	idx.load([]indexedKey{
+		{value: number(10), key: "bob"},
+		{value: number(30), key: "carl"},
+		{value: number(50), key: "ann"},
+		{value: number(60), key: "dana"},
+	})
+	idx.touched = nil
+
+	if keys := idx.find(nil, nil); !reflect.DeepEqual(keys, []string{"eve", "carl", "ann", "dana"}) {
+		t.Errorf("Unexpected keys %v", keys)
+	}
+	if _, ok := idx.values["bob"]; ok {
+		t.Error("Expected the deleted key to be dropped")
+	}
+	min, max := number(40), number(40)
+	if keys := idx.find(&min, &max); !reflect.DeepEqual(keys, []string{"ann"}) {
+		t.Errorf("Unexpected keys %v", keys)
+	}
+
+	// the writes after the build change the index as usual
+	idx.set("carl", nil, false)
+	if keys := idx.find(nil, nil); !reflect.DeepEqual(keys, []string{"eve", "ann", "dana"}) {
+		t.Errorf("Unexpected keys %v", keys)
+	}
+}
@@ -2,10 +2,14 @@ package datastore
 
 import (
 	"bufio"
-	"encoding/binary"
 	"fmt"
 	"io"
+	"math"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 )
 
 const activeSuffix = "active"
@@ -14,98 +18,320 @@ const segmentPrefix = "segment-"
 const bufSize = 8192
 const deletedItemPos = -1
 const deletedValueLength = -1
+const maxRecordSize = math.MaxUint32
 
 type segment struct {
 	path   string
 	offset int64
-	index  hashIndex
+	// format version of the file, the records of the older ones are upgraded as they are read
+	version uint32
+	// headerless segments were written before the header was introduced, their records start at offset 0
+	headerless bool
+	// size of the version marker following the header of a merged segment, zero when there is none
+	markerSize int64
+	// index is nil for the sealed segments which use disk index instead
+	index hashIndex
+	// keys of the in-memory index in sorted order, so the cursor doesn't have to sort the whole index
+	keys *keyList
+	disk *diskIndex
+	// expiration times of the keys put with ttl, most keys don't have one, so they are kept apart from the index
+	expiry map[string]int64
+	// the biggest version written to the segment, including the records which were dropped by merge
+	maxVersion uint64
+	// the number of key operations written to the segment, the ones of a batch are counted separately
+	records int
+	// filter is set for sealed segments only, when bloom filters are enabled
+	filter *bloomFilter
+
+	// reader is opened on the first read and kept until the segment is merged or the database is closed. The file
+	// stays readable through it after addSegment renames it, and merge closes it only after the segment is
+	// removed from the list, when no lookup can reach it. The file isn't opened again once the segment is closed,
+	// its path may already belong to another file
+	readerMux sync.Mutex
+	reader    *os.File
+	closed    bool
+}
+
+func newSegment(path string) *segment {
+	return &segment{
+		path:   path,
+		index:  make(hashIndex),
+		keys:   newKeyList(nil),
+		expiry: make(map[string]int64),
+	}
+}
+
+// Corruption describes a damaged part of a segment file found while opening the database
+type Corruption struct {
+	Path   string
+	Offset int64
+	Size   int64
+}
+
+func (c Corruption) String() string {
+	return fmt.Sprintf("%s: %d corrupted bytes at offset %d", c.Path, c.Size, c.Offset)
+}
+
+func (s *segment) isActive() bool {
+	return strings.HasSuffix(s.path, segmentPrefix+activeSuffix)
 }
 
-func (s *segment) recover() error {
-	input, err := os.Open(s.path)
+// isSegmentFile filters out hint files and the temporary file of an unfinished merge
+func isSegmentFile(name string) bool {
+	if !strings.HasPrefix(name, segmentPrefix) {
+		return false
+	}
+	suffix := name[len(segmentPrefix):]
+	if suffix == activeSuffix || suffix == mergedSuffix {
+		return true
+	}
+	_, err := strconv.Atoi(suffix)
+	return err == nil
+}
+
+// segmentOrder returns the position of the segment in the lookup order, newer segments have bigger numbers
+func segmentOrder(path string) int {
+	suffix := strings.TrimPrefix(filepath.Base(path), segmentPrefix)
+	switch suffix {
+	case activeSuffix:
+		return math.MaxInt32
+	case mergedSuffix:
+		return -1
+	}
+	n, _ := strconv.Atoi(suffix)
+	return n
+}
+
+// recover builds the index of the segment from its records. A read-only database doesn't change the file, and
+// the tail of its active segment may be a record which the writer hasn't finished yet, so it's left unread
+// The read-only database reads the segment through its reader, so the index points into the file it keeps open
+// even if the writer renames the segment and creates a new one with the same name meanwhile
+func (s *segment) recover(policy RecoveryPolicy, readOnly bool) ([]Corruption, error) {
+	var input *os.File
+	var err error
+	if readOnly {
+		input, err = s.readFile()
+	} else {
+		input, err = os.OpenFile(s.path, os.O_RDWR, 0o600)
+		if err == nil {
+			defer input.Close()
+		}
+	}
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer input.Close()
 
-	var buf [bufSize]byte
-	in := bufio.NewReaderSize(input, bufSize)
+	fi, err := input.Stat()
+	if err != nil {
+		return nil, err
+	}
+	fileSize := fi.Size()
 
-	for err == nil {
-		var (
-			header, data []byte
-			n            int
-		)
-		header, err = in.Peek(bufSize)
-		if err == io.EOF {
-			if len(header) == 0 {
-				return err
+	// the torn header is handled as a corrupted record of unknown size
+	headerErr := s.readFormat(input, fileSize)
+	if headerErr != nil && headerErr != ErrCorrupted {
+		return nil, headerErr
+	}
+	in := bufio.NewReaderSize(io.NewSectionReader(input, s.offset, fileSize-s.offset), bufSize)
+	var corruptions []Corruption
+
+	for {
+		var size int64
+		err := headerErr
+		headerErr = nil
+		if err == nil {
+			// we don't need to handle concurrency here, because recover is called before Db creation, and there is no
+			// concurrent access to index(from put, get etc)
+			size, err = s.readRecords(in, fileSize, func(offset int64, entries []*entry, positions []int64) {
+				for i, e := range entries {
+					s.addToIndex(e, offset+positions[i])
+				}
+			})
+		}
+		if err != ErrCorrupted {
+			return corruptions, err
+		}
+
+		// if the size from the header can't be trusted there is no way to find where the next record starts,
+		// so everything up to the end of the file is treated as damaged
+		resync := size != 0
+		if !resync {
+			size = fileSize - s.offset
+		}
+		c := Corruption{Path: s.path, Offset: s.offset, Size: size}
+
+		switch {
+		case readOnly && s.isActive():
+			return corruptions, nil
+		case policy == RecoverSkip && resync:
+			corruptions = append(corruptions, c)
+			s.offset += size
+		case policy == RecoverSkip && !s.isActive():
+			return append(corruptions, c), nil
+		case policy != RecoverFail && s.isActive():
+			// new records are appended to the active segment, so its damaged tail has to be cut off
+			if err := input.Truncate(s.offset); err != nil {
+				return nil, err
 			}
-		} else if err != nil {
-			return err
+			return append(corruptions, c), nil
+		default:
+			return nil, fmt.Errorf("cannot recover %s: %w", c, ErrCorrupted)
 		}
-		size := binary.LittleEndian.Uint32(header)
+	}
+}
 
-		if size < bufSize {
-			data = buf[:size]
-		} else {
-			data = make([]byte, size)
+// readRecords reads records from s.offset up to fileSize and passes every decoded one to visit with its offset.
+// It stops at the first corrupted record and returns ErrCorrupted with the size of the record, which is 0
+// when the record boundary is unknown, leaving s.offset at the start of the record
+func (s *segment) readRecords(in *bufio.Reader, fileSize int64, visit func(offset int64, entries []*entry, positions []int64)) (int64, error) {
+	for s.offset < fileSize {
+		record, err := readRecord(in, fileSize-s.offset, s.version)
+		if err != nil && err != ErrCorrupted {
+			return 0, err
 		}
-		n, err = in.Read(data)
 
+		var (
+			entries   []*entry
+			positions []int64
+			data      []byte
+		)
 		if err == nil {
-			if n != int(size) {
-				return fmt.Errorf("corrupted file")
+			if data, err = upgradeRecord(record, s.version); err == nil {
+				entries, positions, err = decodeRecord(data)
 			}
+		}
+		if err == ErrCorrupted {
+			return int64(len(record)), err
+		}
 
-			var e entry
-			deletedErr := e.Decode(data)
+		visit(s.offset, entries, positions)
+		// the upgraded record may be longer than the one in the file
+		s.offset += int64(len(record))
+	}
+	return 0, nil
+}
 
-			// we don't need to handle concurrency here, because recover is called before Db creation, and there is no
-			// concurrent access to index(from put, get etc)
-			if deletedErr != nil {
-				s.index[e.key] = deletedItemPos
-			} else {
-				s.index[e.key] = s.offset
-			}
+func (s *segment) addToIndex(e *entry, position int64) {
+	s.records++
+	if _, ok := s.index[e.key]; !ok {
+		s.keys.insert(e.key)
+	}
+	if e.deleted {
+		s.index[e.key] = deletedItemPos
+	} else {
+		s.index[e.key] = position
+	}
+	if e.expiresAt != 0 && !e.deleted {
+		s.expiry[e.key] = e.expiresAt
+	} else {
+		delete(s.expiry, e.key)
+	}
+	if e.version > s.maxVersion {
+		s.maxVersion = e.version
+	}
+}
+
+func (s *segment) readFile() (*os.File, error) {
+	s.readerMux.Lock()
+	defer s.readerMux.Unlock()
+	return s.loadReader()
+}
+
+// openFile returns the own handle of the file read through readFile, which the caller closes. It reads the same
+// file even after the segment is merged away or its path is taken by another one
+func (s *segment) openFile() (*os.File, error) {
+	s.readerMux.Lock()
+	defer s.readerMux.Unlock()
+
+	f, err := s.loadReader()
+	if err != nil {
+		return nil, err
+	}
+	return dupFile(f)
+}
 
-			s.offset += int64(n)
+// loadReader opens the reader unless it's already open, it's called under readerMux
+func (s *segment) loadReader() (*os.File, error) {
+	if s.closed {
+		return nil, ErrClosed
+	}
+	if s.reader == nil {
+		f, err := os.Open(s.path)
+		if err != nil {
+			return nil, err
 		}
+		s.reader = f
+	}
+	return s.reader, nil
+}
+
+func (s *segment) close() error {
+	s.readerMux.Lock()
+	defer s.readerMux.Unlock()
+	s.closed = true
+
+	var err error
+	if s.disk != nil {
+		err = s.disk.close()
+	}
+	if s.reader != nil {
+		if closeErr := s.reader.Close(); closeErr != nil {
+			err = closeErr
+		}
+		s.reader = nil
 	}
 	return err
 }
 
 func (s *segment) get(key string) (string, error) {
+	e, err := s.getEntry(key)
+	if err != nil {
+		return "", err
+	}
+	return e.value, nil
+}
 
-	position, ok := s.index[key]
-
-	if !ok && position != 0 {
-		print()
+// find returns the index entry of the key, ErrItemDeleted means that the segment has its tombstone
+func (s *segment) find(key string) (indexEntry, error) {
+	if s.filter != nil && !s.filter.mayContain(key) {
+		return indexEntry{}, ErrNotFound
+	}
+	ie, ok, err := s.lookup(key)
+	if err != nil {
+		return indexEntry{}, err
 	}
 	if !ok {
-		return "", ErrNotFound
+		return indexEntry{}, ErrNotFound
 	}
 
-	if position == deletedItemPos {
-		return "", ErrItemDeleted
+	if ie.position == deletedItemPos {
+		return indexEntry{}, ErrItemDeleted
 	}
+	return ie, nil
+}
 
-	file, err := os.Open(s.path)
+func (s *segment) getEntry(key string) (*entry, error) {
+	ie, err := s.find(key)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	defer file.Close()
 
-	_, err = file.Seek(position, 0)
+	file, err := s.readFile()
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-
-	reader := bufio.NewReader(file)
-	value, err := readValue(reader)
+	e, err := readEntryAt(file, ie.position, s.version)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	// the index must never be applied to another file, but the wrong value is worse than the failed read
+	if e.key != key {
+		return nil, fmt.Errorf("%s has %q instead of %q at %d: %w", s.path, e.key, key, ie.position, ErrCorrupted)
 	}
 
-	return value, nil
+	// expired value hides the older ones just like a tombstone
+	if e.expired() {
+		return nil, ErrItemDeleted
+	}
+	return e, nil
 }
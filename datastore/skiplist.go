@@ -0,0 +1,160 @@
+package datastore
+
+import (
+	"math/rand"
+)
+
+const maxSkipLevel = 32
+
+type skipNode struct {
+	item indexedKey
+	next []*skipNode
+}
+
+// skipList keeps the keys of a field index in the order of their values, so a key is moved in logarithmic time
+// when its value changes and a range is read without copying the whole index
+type skipList struct {
+	head  skipNode
+	level int
+}
+
+func lessIndexed(a, b indexedKey) bool {
+	c := a.value.compare(b.value)
+	return c < 0 || c == 0 && a.key < b.key
+}
+
+// randomLevel returns the number of lists the new node is linked to, every next one takes a quarter of the nodes
+func randomLevel() int {
+	level := 1
+	for level < maxSkipLevel && rand.Intn(4) == 0 {
+		level++
+	}
+	return level
+}
+
+// newSkipList builds the list of the items which are already sorted in linear time
+func newSkipList(items []indexedKey) *skipList {
+	l := &skipList{head: skipNode{next: make([]*skipNode, maxSkipLevel)}}
+	var tails [maxSkipLevel]*skipNode
+	for i := range tails {
+		tails[i] = &l.head
+	}
+	for _, item := range items {
+		n := &skipNode{item: item, next: make([]*skipNode, randomLevel())}
+		for i := range n.next {
+			tails[i].next[i] = n
+			tails[i] = n
+		}
+		if len(n.next) > l.level {
+			l.level = len(n.next)
+		}
+	}
+	return l
+}
+
+// seek returns the first node which is not less than the item, update gets the last node before it in every list
+func (l *skipList) seek(item indexedKey, update []*skipNode) *skipNode {
+	x := &l.head
+	for i := l.level - 1; i >= 0; i-- {
+		for x.next[i] != nil && lessIndexed(x.next[i].item, item) {
+			x = x.next[i]
+		}
+		if update != nil {
+			update[i] = x
+		}
+	}
+	return x.next[0]
+}
+
+func (l *skipList) insert(item indexedKey) {
+	var update [maxSkipLevel]*skipNode
+	l.seek(item, update[:])
+	n := &skipNode{item: item, next: make([]*skipNode, randomLevel())}
+	for i := l.level; i < len(n.next); i++ {
+		update[i] = &l.head
+	}
+	if len(n.next) > l.level {
+		l.level = len(n.next)
+	}
+	for i := range n.next {
+		n.next[i] = update[i].next[i]
+		update[i].next[i] = n
+	}
+}
+
+func (l *skipList) remove(item indexedKey) {
+	var update [maxSkipLevel]*skipNode
+	n := l.seek(item, update[:])
+	if n == nil || n.item.key != item.key || n.item.value.compare(item.value) != 0 {
+		return
+	}
+	for i := range n.next {
+		update[i].next[i] = n.next[i]
+	}
+	for l.level > 0 && l.head.next[l.level-1] == nil {
+		l.level--
+	}
+}
+
+type keyNode struct {
+	key  string
+	next []*keyNode
+}
+
+// keyList is the skip list of the keys of the in-memory segment index. Its nodes keep nothing but the keys,
+// so they don't pay for the field values of skipList
+type keyList struct {
+	head  keyNode
+	level int
+}
+
+// newKeyList builds the list of the keys which are already sorted in linear time
+func newKeyList(keys []string) *keyList {
+	l := &keyList{head: keyNode{next: make([]*keyNode, maxSkipLevel)}}
+	var tails [maxSkipLevel]*keyNode
+	for i := range tails {
+		tails[i] = &l.head
+	}
+	for _, key := range keys {
+		n := &keyNode{key: key, next: make([]*keyNode, randomLevel())}
+		for i := range n.next {
+			tails[i].next[i] = n
+			tails[i] = n
+		}
+		if len(n.next) > l.level {
+			l.level = len(n.next)
+		}
+	}
+	return l
+}
+
+// seek returns the first node which is not less than the key, update gets the last node before it in every list
+func (l *keyList) seek(key string, update []*keyNode) *keyNode {
+	x := &l.head
+	for i := l.level - 1; i >= 0; i-- {
+		for x.next[i] != nil && x.next[i].key < key {
+			x = x.next[i]
+		}
+		if update != nil {
+			update[i] = x
+		}
+	}
+	return x.next[0]
+}
+
+// insert adds the key which isn't in the list yet
+func (l *keyList) insert(key string) {
+	var update [maxSkipLevel]*keyNode
+	l.seek(key, update[:])
+	n := &keyNode{key: key, next: make([]*keyNode, randomLevel())}
+	for i := l.level; i < len(n.next); i++ {
+		update[i] = &l.head
+	}
+	if len(n.next) > l.level {
+		l.level = len(n.next)
+	}
+	for i := range n.next {
+		n.next[i] = update[i].next[i]
+		update[i].next[i] = n
+	}
+}
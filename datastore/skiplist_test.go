@@ -0,0 +1,84 @@
+package datastore
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func TestSkipList(t *testing.T) {
+	var items []indexedKey
+	for i := 0; i < 1000; i++ {
+		items = append(items, indexedKey{value: fieldValue{kind: numberField, num: float64(i % 10)}, key: fmt.Sprintf("key%d", i)})
+	}
+	rand.Shuffle(len(items), func(i, j int) { items[i], items[j] = items[j], items[i] })
+
+	loaded := append([]indexedKey(nil), items[:500]...)
+	sort.Slice(loaded, func(i, j int) bool { return lessIndexed(loaded[i], loaded[j]) })
+	l := newSkipList(loaded)
+	for _, item := range items[500:] {
+		l.insert(item)
+	}
+	for _, item := range items[:250] {
+		l.remove(item)
+	}
+	// removing the key which is not in the list changes nothing
+	l.remove(indexedKey{value: fieldValue{kind: stringField, str: "missing"}, key: "key1"})
+
+	expected := append([]indexedKey(nil), items[250:]...)
+	sort.Slice(expected, func(i, j int) bool { return lessIndexed(expected[i], expected[j]) })
+	var actual []indexedKey
+	for n := l.head.next[0]; n != nil; n = n.next[0] {
+		actual = append(actual, n.item)
+	}
+	if len(actual) != len(expected) {
+		t.Fatalf("Expected %d items, got %d", len(expected), len(actual))
+	}
+	for i := range expected {
+		if actual[i] != expected[i] {
+			t.Fatalf("Expected %v at %d, got %v", expected[i], i, actual[i])
+		}
+	}
+
+	i := sort.Search(len(expected), func(i int) bool { return expected[i].value.num >= 5 })
+	if first := l.seek(indexedKey{value: fieldValue{kind: numberField, num: 5}}, nil); first == nil || first.item != expected[i] {
+		t.Errorf("Expected %v to be the first with value 5, got %v", expected[i], first)
+	}
+}
+
+func TestKeyList(t *testing.T) {
+	var keys []string
+	for i := 0; i < 1000; i++ {
+		keys = append(keys, fmt.Sprintf("key%03d", i))
+	}
+	rand.Shuffle(len(keys), func(i, j int) { keys[i], keys[j] = keys[j], keys[i] })
+
+	loaded := append([]string(nil), keys[:500]...)
+	sort.Strings(loaded)
+	l := newKeyList(loaded)
+	for _, key := range keys[500:] {
+		l.insert(key)
+	}
+
+	sort.Strings(keys)
+	var actual []string
+	for n := l.head.next[0]; n != nil; n = n.next[0] {
+		actual = append(actual, n.key)
+	}
+	if len(actual) != len(keys) {
+		t.Fatalf("Expected %d keys, got %d", len(keys), len(actual))
+	}
+	for i := range keys {
+		if actual[i] != keys[i] {
+			t.Fatalf("Expected %s at %d, got %s", keys[i], i, actual[i])
+		}
+	}
+
+	if n := l.seek("key5", nil); n == nil || n.key != "key500" {
+		t.Errorf("Unexpected node %v", n)
+	}
+	if n := l.seek("key999x", nil); n != nil {
+		t.Errorf("Expected no node after the last key, got %s", n.key)
+	}
+}
@@ -0,0 +1,128 @@
+package datastore
+
+import (
+	"encoding/binary"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+type Stats struct {
+	LiveKeys int `json:"liveKeys"`
+	// Tombstones is the number of deleted keys which still have their tombstones in segments
+	Tombstones int            `json:"tombstones"`
+	Segments   []SegmentStats `json:"segments"`
+	TotalBytes int64          `json:"totalBytes"`
+	// ReclaimableBytes is the size of overwritten, deleted and expired records, the ones merge would drop
+	ReclaimableBytes int64 `json:"reclaimableBytes"`
+
+	Merges             int           `json:"merges"`
+	LastMerge          time.Time     `json:"lastMerge"`
+	LastMergeDuration  time.Duration `json:"lastMergeDuration"`
+	TotalMergeDuration time.Duration `json:"totalMergeDuration"`
+
+	Puts LatencyStats `json:"puts"`
+	Gets LatencyStats `json:"gets"`
+}
+
+type SegmentStats struct {
+	Name    string `json:"name"`
+	Size    int64  `json:"size"`
+	Records int    `json:"records"`
+	// Keys is the number of keys in the segment index, including the deleted ones
+	Keys int `json:"keys"`
+}
+
+type LatencyStats struct {
+	Count uint64        `json:"count"`
+	Total time.Duration `json:"total"`
+	Max   time.Duration `json:"max"`
+}
+
+func (l LatencyStats) Average() time.Duration {
+	if l.Count == 0 {
+		return 0
+	}
+	return l.Total / time.Duration(l.Count)
+}
+
+// latencyCounter is updated by concurrent requests without the database lock
+type latencyCounter struct {
+	count uint64
+	total uint64
+	max   uint64
+}
+
+func (c *latencyCounter) observe(start time.Time) {
+	d := uint64(time.Since(start))
+	atomic.AddUint64(&c.count, 1)
+	atomic.AddUint64(&c.total, d)
+	for {
+		max := atomic.LoadUint64(&c.max)
+		if d <= max || atomic.CompareAndSwapUint64(&c.max, max, d) {
+			return
+		}
+	}
+}
+
+func (c *latencyCounter) stats() LatencyStats {
+	return LatencyStats{
+		Count: atomic.LoadUint64(&c.count),
+		Total: time.Duration(atomic.LoadUint64(&c.total)),
+		Max:   time.Duration(atomic.LoadUint64(&c.max)),
+	}
+}
+
+// Stats describes the current state of the database. The keys are walked and the sizes of live records are read
+// from the segment files after the lock is released, so it takes a disk read per live key
+func (db *Db) Stats() (Stats, error) {
+	var stats Stats
+	var headers int64
+	db.mux.RLock()
+	for _, s := range db.segments {
+		stats.Segments = append(stats.Segments, SegmentStats{
+			Name:    filepath.Base(s.path),
+			Size:    s.offset,
+			Records: s.records,
+			Keys:    s.keyCount(),
+		})
+		stats.TotalBytes += s.offset
+		headers += s.headerSize()
+	}
+	stats.Merges = db.merges
+	stats.LastMerge = db.lastMerge
+	stats.LastMergeDuration = db.lastMergeDuration
+	stats.TotalMergeDuration = db.totalMergeDuration
+	// the snapshot holds the segment files open, so merge can't remove them while the sizes are read
+	snapshot, err := db.snapshot()
+	db.mux.RUnlock()
+	if err != nil {
+		return stats, err
+	}
+	defer snapshot.Close()
+
+	stats.Puts = db.putLatency.stats()
+	stats.Gets = db.getLatency.stats()
+
+	var liveBytes int64
+	var buf [4]byte
+	err = mergeKeys(snapshot.segments, snapshot.cursors, func(s *segment, e indexEntry) (bool, error) {
+		if e.position == deletedItemPos {
+			stats.Tombstones++
+		}
+		if !e.alive(snapshot.taken) {
+			return true, nil
+		}
+		stats.LiveKeys++
+		if _, err := snapshot.files[s].ReadAt(buf[:], e.position); err != nil {
+			return false, err
+		}
+		liveBytes += int64(binary.LittleEndian.Uint32(buf[:]))
+		return true, nil
+	})
+	if err != nil {
+		return stats, err
+	}
+	stats.ReclaimableBytes = stats.TotalBytes - headers - liveBytes
+	return stats, nil
+}
@@ -0,0 +1,355 @@
+package datastore
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// streamed value is spooled to a temporary file first, so a slow writer doesn't hold the put goroutine,
+// which then copies the file right into the active segment
+const streamSuffix = ".stream"
+
+var ErrValueTooLarge = fmt.Errorf("value is too large for a single record")
+
+type spooledValue struct {
+	f    *os.File
+	size int64
+}
+
+// PutStream puts the value of the given size read from r without holding it in memory. Values of an encrypted
+// database are sealed as a whole, so they are read into memory anyway
+func (db *Db) PutStream(key string, r io.Reader, size int64) error {
+	return db.PutStreamContext(context.Background(), key, r, size)
+}
+
+// PutStreamContext is PutStream which stops reading the value and waiting for the write once ctx is done
+func (db *Db) PutStreamContext(ctx context.Context, key string, r io.Reader, size int64) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	return db.putStream(ctx, key, r, size, "")
+}
+
+// contextReader fails the reads with the ctx error once ctx is done
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+func (db *Db) putStream(ctx context.Context, key string, r io.Reader, size int64, bucket string) error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	if size < 0 {
+		return fmt.Errorf("value size must not be negative, got %d", size)
+	}
+	if size >= encryptedValueFlag || int64(len(key))+size+12+metaSize+checksumSize > maxRecordSize {
+		return ErrValueTooLarge
+	}
+	if db.keys != nil {
+		value := make([]byte, size)
+		if _, err := io.ReadFull(contextReader{ctx: ctx, r: r}, value); err != nil {
+			return err
+		}
+		return db.sendContext(ctx, putEntry{entries: []*entry{{key: key, value: string(value)}}, bucket: bucket})
+	}
+
+	f, err := ioutil.TempFile(db.dir, "*"+streamSuffix)
+	if err != nil {
+		return err
+	}
+	remove := func() {
+		f.Close()
+		os.Remove(f.Name())
+	}
+
+	if _, err := io.CopyN(f, contextReader{ctx: ctx, r: r}, size); err != nil {
+		remove()
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return fmt.Errorf("cannot read %d bytes of the value: %w", size, err)
+	}
+	start := time.Now()
+	responseChan, err := db.handOff(ctx, putEntry{entries: []*entry{{key: key}}, stream: &spooledValue{f: f, size: size}, bucket: bucket})
+	if err != nil {
+		remove()
+		return err
+	}
+	defer db.putLatency.observe(start)
+	select {
+	case err := <-responseChan:
+		remove()
+		return err
+	case <-ctx.Done():
+		// the put goroutine may still be copying the spooled value
+		go func() {
+			<-responseChan
+			remove()
+		}()
+		return ctx.Err()
+	}
+}
+
+// writeStream writes the record of the spooled value to the active segment, it's called by the put goroutine
+func (db *Db) writeStream(e *entry, value *spooledValue) error {
+	db.mux.RLock()
+	s := db.segments[0]
+	offset := s.offset
+	indexed := db.indexed(e.key)
+	db.mux.RUnlock()
+
+	// followers read the record from the segment file
+	in, err := s.readFile()
+	if err != nil {
+		return err
+	}
+
+	size := int64(len(e.key)) + value.size + 12 + metaSize + checksumSize
+	hash := crc32.NewIEEE()
+	out := bufio.NewWriterSize(io.MultiWriter(db.out, hash), bufSize)
+
+	header := make([]byte, 8+len(e.key)+4)
+	binary.LittleEndian.PutUint32(header, uint32(size))
+	binary.LittleEndian.PutUint32(header[4:], uint32(len(e.key)))
+	copy(header[8:], e.key)
+	binary.LittleEndian.PutUint32(header[8+len(e.key):], uint32(value.size))
+	out.Write(header)
+
+	_, err = value.f.Seek(0, io.SeekStart)
+	if err == nil {
+		_, err = io.CopyN(out, value.f, value.size)
+	}
+	if err == nil {
+		var meta [metaSize]byte
+		e.putMeta(meta[:])
+		out.Write(meta[:])
+		err = out.Flush()
+	}
+	if err == nil {
+		var checksum [checksumSize]byte
+		binary.LittleEndian.PutUint32(checksum[:], hash.Sum32())
+		_, err = db.out.Write(checksum[:])
+	}
+	if err == nil && db.durability == SyncAlways {
+		err = db.out.Sync()
+	}
+	if err != nil {
+		// the records written later must not follow the torn or unsynced one
+		if truncateErr := db.out.Truncate(offset); truncateErr != nil {
+			log.Printf("cannot remove torn record of %s: %v", e.key, truncateErr)
+		}
+		return err
+	}
+
+	// the values of the buckets with indexes are parsed anyway
+	if indexed {
+		value, err := ioutil.ReadAll(io.NewSectionReader(value.f, 0, value.size))
+		if err != nil {
+			log.Printf("cannot read %s to index it: %v", e.key, err)
+		}
+		e.value = string(value)
+	}
+
+	db.mux.Lock()
+	s.addToIndex(e, offset)
+	db.updateSecondary(e)
+	s.offset += size
+	if e.version > db.indexedVersion {
+		db.indexedVersion = e.version
+	}
+	db.mux.Unlock()
+
+	// the record is too big to keep it in memory
+	db.changes.appendFile(in, offset, size, e.version)
+	return nil
+}
+
+// ValueReader reads the value stored in a segment file, the checksum of the record is checked once the value
+// is read to the end
+type ValueReader struct {
+	f       *os.File
+	in      io.Reader
+	hash    hash.Hash32
+	trailer int64
+	size    int64
+	version uint64
+}
+
+// GetStream returns the reader of the value, which has to be closed. The segment file is kept open by the reader,
+// so the value can be read even if the segment is merged meanwhile
+func (db *Db) GetStream(key string) (*ValueReader, error) {
+	db.mux.RLock()
+	if db.closed {
+		db.mux.RUnlock()
+		return nil, ErrClosed
+	}
+	var (
+		f       *os.File
+		ie      indexEntry
+		version uint32
+		err     error
+	)
+	for _, s := range db.segments {
+		ie, err = s.find(key)
+		if err == ErrNotFound {
+			continue
+		}
+		if err == ErrItemDeleted {
+			err = ErrNotFound
+		}
+		if err == nil {
+			f, err = s.openFile()
+			version = s.version
+		}
+		break
+	}
+	db.mux.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := db.openValue(f, ie, version)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetStreamContext is GetStream which fails with the ctx error once ctx is done, the returned reader isn't bound to ctx
+func (db *Db) GetStreamContext(ctx context.Context, key string) (*ValueReader, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return db.GetStream(key)
+}
+
+// openEntry reads the whole record of the value into memory
+func (db *Db) openEntry(f *os.File, ie indexEntry, version uint32) (*ValueReader, error) {
+	e, err := readEntryAt(f, ie.position, version)
+	if err == nil && e.key != ie.key {
+		err = ErrCorrupted
+	}
+	if err == nil {
+		err = db.keys.decrypt(e)
+	}
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	return &ValueReader{in: strings.NewReader(e.value), size: int64(len(e.value)), version: e.version}, nil
+}
+
+func (db *Db) openValue(f *os.File, ie indexEntry, version uint32) (*ValueReader, error) {
+	if ie.expiresAt != 0 && ie.expiresAt <= now().UnixNano() {
+		return nil, ErrNotFound
+	}
+
+	// encrypted values and the records of older formats are handled as a whole
+	if version != FormatVersion {
+		return db.openEntry(f, ie, version)
+	}
+	var header [8]byte
+	if _, err := f.ReadAt(header[:], ie.position); err != nil {
+		return nil, err
+	}
+	size := int64(binary.LittleEndian.Uint32(header[:]))
+	kl := int64(binary.LittleEndian.Uint32(header[4:]))
+	if size < minRecordSize || kl+12+metaSize+checksumSize > size {
+		return nil, ErrCorrupted
+	}
+	rest := make([]byte, kl+4)
+	if _, err := f.ReadAt(rest, ie.position+8); err != nil {
+		return nil, err
+	}
+	if string(rest[:kl]) != ie.key {
+		return nil, ErrCorrupted
+	}
+	vl := binary.LittleEndian.Uint32(rest[kl:])
+	if vl&encryptedValueFlag != 0 {
+		return db.openEntry(f, ie, version)
+	}
+	if kl+12+int64(vl)+metaSize+checksumSize != size {
+		return nil, ErrCorrupted
+	}
+
+	start := ie.position + 12 + kl
+	r := &ValueReader{
+		f:       f,
+		in:      bufio.NewReaderSize(io.NewSectionReader(f, start, int64(vl)), bufSize),
+		hash:    crc32.NewIEEE(),
+		trailer: start + int64(vl),
+		size:    int64(vl),
+	}
+	r.hash.Write(header[:])
+	r.hash.Write(rest)
+
+	var meta [metaSize]byte
+	if _, err := f.ReadAt(meta[:], r.trailer); err != nil {
+		return nil, err
+	}
+	r.version = binary.LittleEndian.Uint64(meta[8:])
+	return r, nil
+}
+
+func (r *ValueReader) Read(p []byte) (int, error) {
+	n, err := r.in.Read(p)
+	if r.hash != nil {
+		r.hash.Write(p[:n])
+	}
+	if err == io.EOF && r.hash != nil {
+		if checkErr := r.check(); checkErr != nil {
+			return n, checkErr
+		}
+	}
+	return n, err
+}
+
+// check compares the checksum of the record with the one of the bytes which have been read
+func (r *ValueReader) check() error {
+	var trailer [metaSize + checksumSize]byte
+	if _, err := r.f.ReadAt(trailer[:], r.trailer); err != nil {
+		return err
+	}
+	r.hash.Write(trailer[:metaSize])
+	if binary.LittleEndian.Uint32(trailer[metaSize:]) != r.hash.Sum32() {
+		return ErrCorrupted
+	}
+	r.hash = nil
+	return nil
+}
+
+// Size returns the size of the value
+func (r *ValueReader) Size() int64 {
+	return r.size
+}
+
+// Version returns the version of the write which has put the value
+func (r *ValueReader) Version() uint64 {
+	return r.version
+}
+
+func (r *ValueReader) Close() error {
+	if r.f == nil {
+		return nil
+	}
+	return r.f.Close()
+}
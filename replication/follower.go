@@ -0,0 +1,193 @@
+package replication
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/AlmostGreatBand/KPI2-2/datastore"
+)
+
+const defRetryInterval = time.Second
+
+// Follower pulls the records written on the leader and applies them to its own database
+type Follower struct {
+	db     *datastore.Db
+	leader string
+	client *http.Client
+
+	wait          time.Duration
+	retryInterval time.Duration
+
+	mux         sync.Mutex
+	started     bool
+	following   bool
+	applied     uint64
+	leaderVer   uint64
+	lastContact time.Time
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func NewFollower(db *datastore.Db, leader string) *Follower {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Follower{
+		db:            db,
+		leader:        leader,
+		client:        new(http.Client),
+		wait:          maxWait,
+		retryInterval: defRetryInterval,
+		following:     true,
+		applied:       db.LastVersion(),
+		ctx:           ctx,
+		cancel:        cancel,
+		done:          make(chan struct{}),
+	}
+}
+
+func (f *Follower) Start() {
+	f.mux.Lock()
+	f.started = true
+	f.mux.Unlock()
+
+	go func() {
+		defer close(f.done)
+		for f.ctx.Err() == nil {
+			if err := f.pull(); err != nil && f.ctx.Err() == nil {
+				log.Printf("cannot replicate from %s: %v", f.leader, err)
+				select {
+				case <-time.After(f.retryInterval):
+				case <-f.ctx.Done():
+				}
+			}
+		}
+	}()
+}
+
+// Promote stops following the leader, so the database accepts writes
+func (f *Follower) Promote() {
+	f.cancel()
+	f.mux.Lock()
+	started := f.started
+	f.mux.Unlock()
+	if started {
+		<-f.done
+	}
+
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if f.following {
+		log.Printf("promoted to leader at version %d", f.applied)
+	}
+	f.following = false
+}
+
+func (f *Follower) Following() bool {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	return f.following
+}
+
+func (f *Follower) Status() Status {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	status := Status{
+		Role:           "follower",
+		Leader:         f.leader,
+		AppliedVersion: f.applied,
+		LeaderVersion:  f.leaderVer,
+		LastContact:    f.lastContact,
+	}
+	if !f.following {
+		status.Role = "leader"
+		status.Leader = ""
+	}
+	if f.leaderVer > f.applied {
+		status.Lag = f.leaderVer - f.applied
+	}
+	return status
+}
+
+func (f *Follower) pull() error {
+	f.mux.Lock()
+	applied := f.applied
+	f.mux.Unlock()
+
+	url := fmt.Sprintf("%s%s?after=%d&wait=%s", f.leader, changesPath, applied, f.wait)
+	resp, err := f.get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusGone {
+		return f.resync(applied)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected response status %d", resp.StatusCode)
+	}
+
+	leaderVersion, err := strconv.ParseUint(resp.Header.Get(lastVersionHeader), 10, 64)
+	if err != nil {
+		return fmt.Errorf("bad leader version: %v", err)
+	}
+	records, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	last, err := f.db.ApplyChanges(records)
+	if last > applied {
+		applied = last
+	}
+	f.update(applied, leaderVersion)
+	return err
+}
+
+// resync replaces the database content with the leader snapshot when the needed changes are not available
+func (f *Follower) resync(applied uint64) error {
+	log.Printf("changes after version %d are not available on %s, loading snapshot", applied, f.leader)
+	resp, err := f.get(f.leader + snapshotPath)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected snapshot response status %d", resp.StatusCode)
+	}
+	version, err := strconv.ParseUint(resp.Header.Get(snapshotVersionHeader), 10, 64)
+	if err != nil {
+		return fmt.Errorf("bad snapshot version: %v", err)
+	}
+
+	if err := f.db.ApplySnapshot(resp.Body, version); err != nil {
+		return err
+	}
+	f.update(version, version)
+	return nil
+}
+
+func (f *Follower) get(url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(f.ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return f.client.Do(req)
+}
+
+func (f *Follower) update(applied, leaderVersion uint64) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.applied = applied
+	f.leaderVer = leaderVersion
+	f.lastContact = time.Now()
+}
@@ -0,0 +1,103 @@
+package replication
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/AlmostGreatBand/KPI2-2/datastore"
+)
+
+const changesPath = "/replication/changes"
+const snapshotPath = "/replication/snapshot"
+const statusPath = "/replication/status"
+const promotePath = "/replication/promote"
+
+const lastVersionHeader = "Replication-Last-Version"
+const snapshotVersionHeader = "Replication-Snapshot-Version"
+
+// long polling has to finish before the server write timeout
+const maxWait = 5 * time.Second
+
+type Status struct {
+	Role           string    `json:"role"`
+	Leader         string    `json:"leader,omitempty"`
+	AppliedVersion uint64    `json:"appliedVersion"`
+	LeaderVersion  uint64    `json:"leaderVersion"`
+	Lag            uint64    `json:"lag"`
+	LastContact    time.Time `json:"lastContact"`
+}
+
+// Register adds replication endpoints to the server. Every server is able to be a leader, follower is nil
+// for the servers which were started as leaders
+func Register(h *http.ServeMux, db *datastore.Db, follower *Follower) {
+	h.HandleFunc(changesPath, func(rw http.ResponseWriter, r *http.Request) {
+		after, err := strconv.ParseUint(r.URL.Query().Get("after"), 10, 64)
+		if err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		wait, _ := time.ParseDuration(r.URL.Query().Get("wait"))
+		if wait > maxWait {
+			wait = maxWait
+		}
+
+		records, err := db.Changes(after, wait)
+		if err == datastore.ErrLogTruncated {
+			rw.WriteHeader(http.StatusGone)
+			return
+		}
+		if err != nil {
+			log.Printf("cannot read changes: %v", err)
+			rw.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		rw.Header().Set("Content-Type", "application/octet-stream")
+		rw.Header().Set(lastVersionHeader, strconv.FormatUint(db.LastVersion(), 10))
+		if _, err := rw.Write(records); err != nil {
+			log.Printf("cannot write changes: %v", err)
+		}
+	})
+
+	h.HandleFunc(snapshotPath, func(rw http.ResponseWriter, r *http.Request) {
+		snapshot, err := db.Snapshot()
+		if err != nil {
+			log.Printf("cannot create snapshot: %v", err)
+			rw.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		defer snapshot.Close()
+
+		rw.Header().Set("Content-Type", "application/octet-stream")
+		rw.Header().Set(snapshotVersionHeader, strconv.FormatUint(snapshot.Version, 10))
+		if _, err := snapshot.WriteTo(rw); err != nil {
+			log.Printf("cannot write snapshot: %v", err)
+		}
+	})
+
+	h.HandleFunc(statusPath, func(rw http.ResponseWriter, r *http.Request) {
+		status := Status{Role: "leader", AppliedVersion: db.LastVersion(), LeaderVersion: db.LastVersion()}
+		if follower != nil && follower.Following() {
+			status = follower.Status()
+		}
+
+		rw.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(rw).Encode(status); err != nil {
+			log.Printf("cannot write status: %v", err)
+		}
+	})
+
+	h.HandleFunc(promotePath, func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if follower != nil {
+			follower.Promote()
+		}
+		rw.WriteHeader(http.StatusOK)
+	})
+}
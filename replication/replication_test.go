@@ -0,0 +1,143 @@
+package replication
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/AlmostGreatBand/KPI2-2/datastore"
+)
+
+func openDb(t *testing.T, logSize int) *datastore.Db {
+	dir, err := ioutil.TempDir("", "test-replication")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	opts := datastore.DefaultOptions()
+	opts.ReplicationLogSize = logSize
+	db, err := datastore.NewDbWithOptions(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func startLeader(t *testing.T, db *datastore.Db) string {
+	h := new(http.ServeMux)
+	Register(h, db, nil)
+	server := httptest.NewServer(h)
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+func startFollower(t *testing.T, db *datastore.Db, leader string) *Follower {
+	f := NewFollower(db, leader)
+	f.wait = 50 * time.Millisecond
+	f.retryInterval = 10 * time.Millisecond
+	f.Start()
+	t.Cleanup(f.Promote)
+	return f
+}
+
+func waitFor(t *testing.T, db *datastore.Db, key, value string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		v, err := db.Get(key)
+		if value == "" && err == datastore.ErrNotFound {
+			return
+		}
+		if err == nil && v == value {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("%s is not replicated, expected value %q", key, value)
+}
+
+func TestReplication(t *testing.T) {
+	leaderDb := openDb(t, 1024*1024)
+	followerDb := openDb(t, 1024*1024)
+
+	if err := leaderDb.Put("key1", "value1"); err != nil {
+		t.Fatal(err)
+	}
+	f := startFollower(t, followerDb, startLeader(t, leaderDb))
+	waitFor(t, followerDb, "key1", "value1")
+
+	b := datastore.NewWriteBatch()
+	b.Put("key2", "value2")
+	b.Delete("key1")
+	if err := leaderDb.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, followerDb, "key2", "value2")
+	waitFor(t, followerDb, "key1", "")
+
+	_, leaderVersion, _ := leaderDb.GetWithVersion("key2")
+	_, followerVersion, _ := followerDb.GetWithVersion("key2")
+	if leaderVersion != followerVersion {
+		t.Errorf("Versions differ: %d on leader, %d on follower", leaderVersion, followerVersion)
+	}
+
+	status := f.Status()
+	if status.Role != "follower" || status.AppliedVersion != leaderDb.LastVersion() || status.Lag != 0 {
+		t.Errorf("Unexpected status %+v", status)
+	}
+
+	t.Run("promote", func(t *testing.T) {
+		f.Promote()
+		if f.Following() || f.Status().Role != "leader" {
+			t.Fatal("Follower is not promoted")
+		}
+
+		if err := leaderDb.Put("key3", "value3"); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(100 * time.Millisecond)
+		if _, err := followerDb.Get("key3"); err != datastore.ErrNotFound {
+			t.Errorf("Promoted follower still replicates: %v", err)
+		}
+
+		if err := followerDb.Put("key4", "value4"); err != nil {
+			t.Fatal(err)
+		}
+		if _, version, _ := followerDb.GetWithVersion("key4"); version <= followerVersion {
+			t.Errorf("Version %d after promotion is not bigger than replicated %d", version, followerVersion)
+		}
+	})
+}
+
+func TestReplication_Snapshot(t *testing.T) {
+	// the log keeps just a couple of records, so the follower has to start from a snapshot
+	leaderDb := openDb(t, 100)
+	followerDb := openDb(t, 100)
+
+	if err := followerDb.Put("stale", "value"); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"key1", "key2", "key3", "key4", "key5"} {
+		if err := leaderDb.Put(key, "value-"+key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := leaderDb.Delete("key2"); err != nil {
+		t.Fatal(err)
+	}
+
+	startFollower(t, followerDb, startLeader(t, leaderDb))
+	waitFor(t, followerDb, "key5", "value-key5")
+	waitFor(t, followerDb, "stale", "")
+	waitFor(t, followerDb, "key2", "")
+	waitFor(t, followerDb, "key1", "value-key1")
+
+	if err := leaderDb.Put("key6", "value-key6"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, followerDb, "key6", "value-key6")
+}
@@ -0,0 +1,93 @@
+package shard
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+)
+
+const DefaultVirtualNodes = 100
+
+// Ring maps keys to nodes with consistent hashing: every node is placed on the ring many times (virtual nodes),
+// and a key belongs to the first virtual node after its hash, so adding or removing a node moves only its keys.
+// Ring is not safe for concurrent modification
+type Ring struct {
+	virtualNodes int
+	hashes       []uint32
+	owners       map[uint32]string
+	nodes        map[string]bool
+}
+
+func NewRing(nodes []string, virtualNodes int) *Ring {
+	if virtualNodes <= 0 {
+		virtualNodes = DefaultVirtualNodes
+	}
+	r := &Ring{
+		virtualNodes: virtualNodes,
+		owners:       make(map[uint32]string),
+		nodes:        make(map[string]bool),
+	}
+	for _, node := range nodes {
+		r.Add(node)
+	}
+	return r
+}
+
+func hash(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
+
+func (r *Ring) Add(node string) {
+	if r.nodes[node] {
+		return
+	}
+	r.nodes[node] = true
+	for i := 0; i < r.virtualNodes; i++ {
+		h := hash(fmt.Sprintf("%s#%d", node, i))
+		owner, taken := r.owners[h]
+		// collisions are resolved the same way regardless of the order nodes are added in
+		if taken && owner < node {
+			continue
+		}
+		if !taken {
+			r.hashes = append(r.hashes, h)
+		}
+		r.owners[h] = node
+	}
+	sort.Slice(r.hashes, func(i, j int) bool { return r.hashes[i] < r.hashes[j] })
+}
+
+func (r *Ring) Remove(node string) {
+	if !r.nodes[node] {
+		return
+	}
+	delete(r.nodes, node)
+
+	// rebuilding is the simplest way to give the collided virtual nodes back to the other nodes
+	nodes := r.Nodes()
+	*r = *NewRing(nodes, r.virtualNodes)
+}
+
+// Node returns the node the key belongs to, or an empty string if the ring is empty
+func (r *Ring) Node(key string) string {
+	if len(r.hashes) == 0 {
+		return ""
+	}
+	h := hash(key)
+	i := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+	if i == len(r.hashes) {
+		i = 0
+	}
+	return r.owners[r.hashes[i]]
+}
+
+func (r *Ring) Nodes() []string {
+	var res []string
+	for node := range r.nodes {
+		res = append(res, node)
+	}
+	sort.Strings(res)
+	return res
+}
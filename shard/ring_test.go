@@ -0,0 +1,67 @@
+package shard
+
+import (
+	"fmt"
+	"testing"
+)
+
+func keys(n int) []string {
+	var res []string
+	for i := 0; i < n; i++ {
+		res = append(res, fmt.Sprintf("key%d", i))
+	}
+	return res
+}
+
+func TestRing_Distribution(t *testing.T) {
+	r := NewRing([]string{"db1:8080", "db2:8080", "db3:8080"}, DefaultVirtualNodes)
+
+	counts := make(map[string]int)
+	for _, key := range keys(30000) {
+		counts[r.Node(key)]++
+	}
+	if len(counts) != 3 {
+		t.Fatalf("Keys are not spread over all nodes: %v", counts)
+	}
+	for node, count := range counts {
+		if count < 7000 || count > 13000 {
+			t.Errorf("Unbalanced node %s with %d of 30000 keys", node, count)
+		}
+	}
+}
+
+func TestRing_AddRemove(t *testing.T) {
+	r := NewRing([]string{"db1:8080", "db2:8080", "db3:8080"}, DefaultVirtualNodes)
+	before := make(map[string]string)
+	for _, key := range keys(10000) {
+		before[key] = r.Node(key)
+	}
+
+	r.Add("db4:8080")
+	moved := 0
+	for key, node := range before {
+		if current := r.Node(key); current != node {
+			moved++
+			if current != "db4:8080" {
+				t.Fatalf("%s moved from %s to %s instead of the new node", key, node, current)
+			}
+		}
+	}
+	if moved < 1500 || moved > 3500 {
+		t.Errorf("Unexpected number of moved keys %d of 10000", moved)
+	}
+
+	r.Remove("db4:8080")
+	for key, node := range before {
+		if current := r.Node(key); current != node {
+			t.Errorf("%s is on %s after the node is removed, expected %s", key, current, node)
+		}
+	}
+
+	reordered := NewRing([]string{"db3:8080", "db1:8080", "db2:8080"}, DefaultVirtualNodes)
+	for key, node := range before {
+		if current := reordered.Node(key); current != node {
+			t.Fatalf("Ring depends on the order of nodes: %s is on %s and %s", key, node, current)
+		}
+	}
+}
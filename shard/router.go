@@ -0,0 +1,44 @@
+package shard
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Router builds db server urls for keys, so every key is always stored on the same shard
+type Router struct {
+	ring *Ring
+}
+
+// NewRouter creates a router for the db servers given as comma separated host:port list
+func NewRouter(servers string, virtualNodes int) (*Router, error) {
+	nodes := ParseNodes(servers)
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("no db servers in %q", servers)
+	}
+	return &Router{ring: NewRing(nodes, virtualNodes)}, nil
+}
+
+func ParseNodes(servers string) []string {
+	var nodes []string
+	for _, node := range strings.Split(servers, ",") {
+		if node = strings.TrimSpace(node); node != "" {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
+func (r *Router) Node(key string) string {
+	return r.ring.Node(key)
+}
+
+// Url returns the address of the key on its db server
+func (r *Router) Url(key string) string {
+	return KeyUrl(r.ring.Node(key), key)
+}
+
+func KeyUrl(node, key string) string {
+	return fmt.Sprintf("http://%s/db/%s", node, url.PathEscape(key))
+}